@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 上传的归档格式
+const (
+	archiveTgz = "tgz" // tar.gz
+	archiveZip = "zip"
+)
+
+var (
+	errArchiveErr    = errors.New("Invalid archive")
+	errUploadSize    = errors.New("Upload too large")
+	errEntrypointErr = errors.New("Invalid entrypoint")
+	entrypointRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-/]+$`)
+)
+
+// uploadParse 解析上传选项: 程序选项(见optionsParse), 描述信息(description, owner)及归档格式、入口文件
+// archive: tgz, zip; entrypoint: 归档中入口源文件的相对路径, 未指定时为sourceName, 仅可与archive同时指定
+func uploadParse(s *programInfo, opt url.Values) (err error) {
+	if s.options, err = optionsParse(opt); err != nil {
+		return err
+	}
+	s.description, s.owner = opt.Get("description"), opt.Get("owner")
+	archive, entrypoint := opt.Get("archive"), opt.Get("entrypoint")
+	switch archive {
+	case "", archiveTgz, archiveZip:
+	default:
+		return errArchiveErr
+	}
+	if entrypoint != "" {
+		if archive == "" || !entrypointRegexp.MatchString(entrypoint) {
+			return errEntrypointErr
+		}
+		if entrypoint, err = archiveName(entrypoint); err != nil {
+			return errEntrypointErr
+		}
+	}
+	s.options.Archive, s.options.Entrypoint = archive, entrypoint
+	return nil
+}
+
+// legacyArchivePath 旧版本保存上传的归档的路径, 加载时导入对象存储(见objectStore.go)
+func legacyArchivePath(p programInfo) string {
+	return storePath + "/.archives/" + string(p.id) + "." + strconv.Itoa(p.revision) + "." + p.options.Archive
+}
+
+// archiveName 检查归档中的文件名, 拒绝绝对路径及".."
+func archiveName(name string) (string, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errArchiveErr
+	}
+	return name, nil
+}
+
+// unpack 将归档解压到dir, 仅接受目录及普通文件(拒绝链接、设备等)
+// 文件数及解压后的总大小受conf.Upload限制, 按实际写入的字节计算
+func unpack(format, archive, dir string) error {
+	u := unpacker{dir: dir, remain: conf.Upload.MaxUnpackedSize}
+	switch format {
+	case archiveTgz:
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return errArchiveErr
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errArchiveErr
+			}
+			switch h.Typeflag {
+			case tar.TypeDir:
+				err = u.mkdir(h.Name)
+			case tar.TypeReg, tar.TypeRegA:
+				err = u.file(h.Name, os.FileMode(h.Mode), tr)
+			case tar.TypeXGlobalHeader:
+			default:
+				err = errArchiveErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case archiveZip:
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return errArchiveErr
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			mode := f.Mode()
+			switch {
+			case mode.IsDir():
+				err = u.mkdir(f.Name)
+			case mode.IsRegular():
+				var r io.ReadCloser
+				if r, err = f.Open(); err != nil {
+					return errArchiveErr
+				}
+				err = u.file(f.Name, mode, r)
+				r.Close()
+			default:
+				err = errArchiveErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errArchiveErr
+}
+
+type unpacker struct {
+	dir    string
+	files  int
+	remain int64 // 剩余可写入的字节数
+}
+
+func (u *unpacker) mkdir(name string) error {
+	name, err := archiveName(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(u.dir, filepath.FromSlash(name)), 0755)
+}
+
+func (u *unpacker) file(name string, mode os.FileMode, r io.Reader) error {
+	name, err := archiveName(name)
+	if err != nil {
+		return err
+	}
+	if u.files++; u.files > conf.Upload.MaxFiles {
+		return errUploadSize
+	}
+	target := filepath.Join(u.dir, filepath.FromSlash(name))
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	w, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(r, u.remain+1))
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return errArchiveErr
+	}
+	if u.remain -= n; u.remain < 0 {
+		return errUploadSize
+	}
+	return nil
+}
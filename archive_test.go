@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveTestEntry 归档中的一项, name以"/"结尾时为目录
+type archiveTestEntry struct {
+	name string
+	body string
+	link bool // 指向body的符号链接
+}
+
+// archiveTestWrite 以format格式生成归档文件
+func archiveTestWrite(t *testing.T, format string, entries []archiveTestEntry) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	switch format {
+	case archiveTgz:
+		gz := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			h := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+			switch {
+			case e.link:
+				h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.body, 0
+			case strings.HasSuffix(e.name, "/"):
+				h.Typeflag, h.Mode = tar.TypeDir, 0755
+			}
+			if err := tw.WriteHeader(h); err != nil {
+				t.Fatal(err)
+			}
+			if h.Typeflag == tar.TypeReg {
+				tw.Write([]byte(e.body))
+			}
+		}
+		tw.Close()
+		gz.Close()
+	case archiveZip:
+		zw := zip.NewWriter(buf)
+		for _, e := range entries {
+			h := &zip.FileHeader{Name: e.name}
+			switch {
+			case e.link:
+				h.SetMode(os.ModeSymlink | 0777)
+			case strings.HasSuffix(e.name, "/"):
+				h.SetMode(os.ModeDir | 0755)
+			default:
+				h.SetMode(0644)
+			}
+			w, err := zw.CreateHeader(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(e.name, "/") {
+				w.Write([]byte(e.body))
+			}
+		}
+		zw.Close()
+	}
+	name := filepath.Join(t.TempDir(), "upload."+format)
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// 拒绝"../"、绝对路径及符号链接, 文件数及解压大小恰好超过上限时拒绝
+func TestUnpack(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.Upload.MaxFiles, conf.Upload.MaxUnpackedSize = 3, 10
+	for _, c := range []struct {
+		name    string
+		entries []archiveTestEntry
+		want    error
+	}{
+		{"ok", []archiveTestEntry{{name: "pkg/"}, {name: "pkg/a.py", body: "a"}, {name: "main.py", body: "main"}}, nil},
+		{"parent", []archiveTestEntry{{name: "../evil.py", body: "x"}}, errArchiveErr},
+		{"nested parent", []archiveTestEntry{{name: "pkg/../../evil.py", body: "x"}}, errArchiveErr},
+		{"parent dir", []archiveTestEntry{{name: "../evil/"}}, errArchiveErr},
+		{"absolute", []archiveTestEntry{{name: "/tmp/evil.py", body: "x"}}, errArchiveErr},
+		{"symlink", []archiveTestEntry{{name: "main.py", body: "/etc/passwd", link: true}}, errArchiveErr},
+		{"max files", []archiveTestEntry{{name: "a", body: "a"}, {name: "b", body: "b"}, {name: "c", body: "c"}}, nil},
+		{"too many files", []archiveTestEntry{{name: "a", body: "a"}, {name: "b", body: "b"}, {name: "c", body: "c"}, {name: "d", body: "d"}}, errUploadSize},
+		{"max size", []archiveTestEntry{{name: "a", body: "01234"}, {name: "b", body: "56789"}}, nil},
+		{"too large", []archiveTestEntry{{name: "a", body: "01234"}, {name: "b", body: "567890"}}, errUploadSize},
+		{"too large file", []archiveTestEntry{{name: "a", body: "01234567890"}}, errUploadSize},
+	} {
+		for _, format := range []string{archiveTgz, archiveZip} {
+			root := t.TempDir()
+			dir := filepath.Join(root, "program")
+			err := unpack(format, archiveTestWrite(t, format, c.entries), dir)
+			if err != c.want {
+				t.Errorf("%s %s: %v, want %v", format, c.name, err, c.want)
+				continue
+			}
+			for _, name := range []string{"evil.py", "evil"} {
+				if _, e := os.Lstat(filepath.Join(root, name)); e == nil {
+					t.Errorf("%s %s: wrote %s outside the program directory", format, c.name, name)
+				}
+			}
+			if err == nil {
+				for _, e := range c.entries {
+					if pathStat(filepath.Join(dir, filepath.FromSlash(e.name))) == notExist {
+						t.Errorf("%s %s: %s not unpacked", format, c.name, e.name)
+					}
+				}
+			}
+		}
+	}
+}
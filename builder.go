@@ -1,125 +1,293 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	execGo = "/usr/bin/go"
 	execPy = "/usr/local/bin/pylint"
 )
 
+var (
+	javaPackageRegexp = regexp.MustCompile(`(?m)^\s*package\s+([\w.]+)\s*;`)
+	errBuildRuntime   = errors.New("Runtime local ignores build images, compiled languages need runtime docker")
+	errImageNotReady  = errors.New("Program image is being built, retry later")
+
+	imagePending = make(map[imageKey]struct{}) // 等待后台构建镜像的版本
+	imageLock    = sync.Mutex{}                // imagePending的锁
+	imageNotify  = make(chan struct{}, 1)      // 有新的构建请求
+)
+
+// imageKey 程序的一个版本
+type imageKey struct {
+	id       programIndex
+	revision int
+}
+
 type execErr struct {
 	cmd     string
 	errMsg  string
 	errCode int
 }
 
-func builder(p programInfo) error {
+// builder 编译程序, 解释型语言构建包含依赖的镜像并记录于p.options.Image
+func builder(p *programInfo) error {
 	switch p.file {
-	case python2:
-		return py2Builder(p.dir)
-	case python3:
-		return py3Builder(p.dir)
+	case python2, python3, nodejs:
+		if p.file != nodejs {
+			if err := resolveDepends(p.dir, p.entrypoint()); err != nil {
+				return err
+			}
+		}
+		ref := imageRef(*p)
+		if err := checkRunCmd(*p, ref); err != nil {
+			return err
+		}
+		p.options.Image = ref
+		return nil
 	case golang:
-		return goBuilder(pwd + p.dir)
+		return goBuilder(p.dir, p.entrypoint())
+	case java:
+		return javaBuilder(p.dir)
+	case cpp:
+		return cppBuilder(p.dir)
 	default:
 		return errTypeErr
 	}
 }
 
-func py2Builder(dir string) error {
-	if err := resolveDepends(dir); err != nil {
-		return err
+// imageReady 程序镜像是否存在且与当前依赖一致, 不需要镜像时返回true
+func imageReady(p programInfo) bool {
+	ref := imageRef(p)
+	return ref == "" || (p.options.Image == ref && rt.ImageExists(context.Background(), ref))
+}
+
+// imageRequest 请求后台重新构建该版本的程序镜像, 不等待构建完成
+func imageRequest(p programInfo) {
+	imageLock.Lock()
+	imagePending[imageKey{p.id, p.revision}] = struct{}{}
+	imageLock.Unlock()
+	select {
+	case imageNotify <- struct{}{}:
+	default:
 	}
-	return dockerRunCmd(python3, dir)
 }
 
-func py3Builder(dir string) error {
-	if err := resolveDepends(dir); err != nil {
-		return err
+// imageNext 取出一个待构建的版本, 程序或版本已删除的请求直接丢弃
+func imageNext() (programInfo, bool) {
+	imageLock.Lock()
+	defer imageLock.Unlock()
+	for k := range imagePending {
+		delete(imagePending, k)
+		if p, err := revisionGet(k.id, k.revision); err == nil {
+			return p, true
+		}
 	}
-	return dockerRunCmd(python3, dir)
+	return programInfo{}, false
 }
 
-func goBuilder(dir string) error {
-	// create go.mod
-	cmd := exec.Cmd{
-		Path: execGo,
-		Args: []string{execGo, "mod", "init", "main"},
-		Dir:  dir,
+// imageScan 检查全部版本, 请求构建镜像不存在或依赖已变化的版本
+func imageScan() {
+	var list []programInfo
+	programLock.RLock()
+	for _, e := range programMapping {
+		for _, p := range e.revisions {
+			list = append(list, p)
+		}
 	}
-	err := runCmd(&cmd)
-	if err != nil {
+	programLock.RUnlock()
+	for _, p := range list {
+		if !imageReady(p) {
+			imageRequest(p)
+		}
+	}
+}
+
+// imageMaintain 在后台构建程序镜像: 启动时及每小时检查全部版本, 其余时间处理imageRequest的请求
+// plz call this function with go routine
+func imageMaintain() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	imageScan()
+	for {
+		select {
+		case <-ctxRoot.Done():
+			return
+		case <-ticker.C:
+			imageScan()
+			continue
+		case <-imageNotify:
+		}
+		for ctxRoot.Err() == nil {
+			p, ok := imageNext()
+			if !ok {
+				break
+			}
+			if imageReady(p) { // 已由之前的请求构建
+				continue
+			}
+			if err := imageBuild(p); err != nil {
+				logger.Printf("Program: %s build image: %v.\n", p.id, err)
+			}
+		}
+	}
+}
+
+// imageBuild 按当前依赖重新构建程序镜像并更新程序配置, 成功后删除旧镜像
+func imageBuild(p programInfo) error {
+	ref := imageRef(p)
+	logger.Printf("Program: %s build image %s.\n", p.id, ref)
+	if err := checkRunCmd(p, ref); err != nil {
 		return err
 	}
+	programLock.Lock()
+	var v programInfo
+	e, ok := programMapping[p.id]
+	if ok {
+		v, ok = e.revisions[p.revision]
+	}
+	old := v.options.Image
+	if ok {
+		v.options.Image = ref
+		e.revisions[p.revision] = v
+	}
+	programLock.Unlock()
+	if !ok { // 构建期间程序已被删除
+		rt.ImageRemove(context.Background(), ref)
+		return errNoID
+	}
+	if err := v.cfgStore(); err != nil {
+		logger.Println(err)
+	}
+	if old != "" && old != ref {
+		rt.ImageRemove(context.Background(), old)
+	}
+	return nil
+}
 
-	// build
-	cmd = exec.Cmd{
-		Path: execGo,
-		Args: []string{execGo, "build", "-ldflags", "-s -w"},
-		Dir:  dir,
+// goBuilder 在conf.Build.GoImage中编译入口文件所在的包(禁用cgo), 可执行文件复制回dir/main
+// 支持上传的go.mod、go.sum及vendor目录, 未上传go.mod时以main为模块名创建
+func goBuilder(dir, entry string) error {
+	env := []string{"CGO_ENABLED=0"}
+	if pathStat(dir+"/vendor") == directory {
+		env = append(env, "GOFLAGS=-mod=vendor")
 	}
-	err = runCmd(&cmd)
-	return err
+	cmd := "[ -f go.mod ] || go mod init main 2>/dev/null; go build -trimpath -ldflags '-s -w' -o main ./" + path.Dir(entry)
+	return sandboxBuild(dir, conf.Build.GoImage, "go build", cmd, env, "main")
 }
 
-func (t execErr) Error() string {
-	return fmt.Sprintf("cmd: %s return %d, errMsg: %s", t.cmd, t.errCode, t.errMsg)
+// javaBuilder 存在pom.xml时使用Maven打包(取target下的第一个jar), 否则以javac编译全部源文件
+// 产物为dir/app.jar, 入口类见javaMainClass
+func javaBuilder(dir string) error {
+	cmd := "if [ -f pom.xml ]; then mvn -q -B package -DskipTests && cp \"$(ls target/*.jar | head -n 1)\" app.jar; " +
+		"else mkdir -p /tmp/classes && javac -encoding UTF-8 -d /tmp/classes $(find . -name '*.java') && jar cf app.jar -C /tmp/classes .; fi"
+	return sandboxBuild(dir, conf.Build.JavaImage, "javac", cmd, nil, "app.jar")
+}
+
+// javaMainClass 入口文件对应的类名, 包名取自文件中的package声明
+func javaMainClass(dir, entry string) string {
+	class := strings.TrimSuffix(path.Base(entry), ".java")
+	buf, _ := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(entry)))
+	if m := javaPackageRegexp.FindSubmatch(buf); m != nil {
+		class = string(m[1]) + "." + class
+	}
+	return class
+}
+
+// cppBuilder 存在CMakeLists.txt时使用CMake(目标名为main, 需镜像中包含cmake), 否则以g++编译全部.c/.cc/.cpp文件
+func cppBuilder(dir string) error {
+	cmd := "if [ -f CMakeLists.txt ]; then cmake -S . -B /tmp/build -DCMAKE_BUILD_TYPE=Release && cmake --build /tmp/build && cp /tmp/build/main main; " +
+		"else g++ -O2 -std=c++17 -pthread -o main $(find . -name '*.cpp' -o -name '*.cc' -o -name '*.c'); fi"
+	return sandboxBuild(dir, conf.Build.CppImage, "g++", cmd, nil, "main")
 }
 
-func runCmd(cmd *exec.Cmd) error {
-	stdOut, _ := cmd.StdoutPipe()
-	var err error
-	if err = cmd.Start(); err != nil {
+// sandboxBuild 在image中执行编译命令cmd, 成功后将产物output复制回dir
+// 失败时以execErr返回编译器的输出
+func sandboxBuild(dir, image, name, cmd string, env []string, output string) error {
+	if _, ok := rt.(*localRuntime); ok { // 不使用宿主机上的工具链
+		return errBuildRuntime
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Build.Timeout.Duration)
+	defer cancel()
+	id, err := rt.Create(ctx, containerSpec{
+		Image:      image,
+		Cmd:        []string{"sh", "-c", cmd},
+		Env:        env,
+		WorkingDir: "/app",
+		Limits:     conf.Limits,
+		Network:    networkFull, // 下载依赖
+	})
+	if err != nil {
+		return err
+	}
+	defer rt.Remove(context.Background(), id)
+	if err = rt.CopyIn(ctx, id, "/app/", dir); err != nil {
 		return err
 	}
-	out, _ := ioutil.ReadAll(stdOut)
-	err = cmd.Wait()
+	returnCode, stderr, err := sandboxExec(ctx, id)
 	if err != nil {
-		var cmdStr string
-		if len(cmd.Args) == 0 {
-			cmdStr = cmd.Path
-		} else {
-			cmdStr = cmd.Path + " " + cmd.Args[0]
-		}
+		return err
+	}
+	if returnCode != 0 {
 		return execErr{
-			cmd:     cmdStr,
-			errMsg:  string(out),
-			errCode: cmd.ProcessState.ExitCode(),
+			cmd:     name,
+			errMsg:  stderr,
+			errCode: int(returnCode),
 		}
 	}
-	return err
+	return rt.CopyOut(ctx, id, "/app/"+output, dir)
 }
 
-func resolveDepends(dir string) error {
-	if dir[len(dir)-1] != filepath.Separator {
-		dir = string(append([]byte(dir), filepath.Separator))
+func (t execErr) Error() string {
+	return fmt.Sprintf("cmd: %s return %d, errMsg: %s", t.cmd, t.errCode, t.errMsg)
+}
+
+// resolveDepends 将入口文件开头"#requests"与"#end"之间的依赖写入requirements.txt, 跳过空行, 缺少"#end"时读到文件末尾
+// 程序目录中已有requirements.txt(如归档中上传)时不生成; 入口文件没有依赖声明时生成空文件
+func resolveDepends(dir, entry string) error {
+	name := filepath.Join(dir, "requirements.txt")
+	if pathStat(name) != notExist {
+		return nil
 	}
-	out, err := os.OpenFile(dir+"requirements.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(entry)))
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-	f, err := os.Open(dir + "main.py")
-	if err != nil {
+	defer f.Close()
+	var deps strings.Builder
+	s := bufio.NewScanner(f)
+	if s.Scan() && strings.TrimSpace(s.Text()) == "#requests" {
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "#end" {
+				break
+			}
+			if line = strings.TrimSpace(strings.TrimPrefix(line, "#")); line != "" {
+				deps.WriteString(line + "\n")
+			}
+		}
+	}
+	if err = s.Err(); err != nil {
 		return err
 	}
-	defer f.Close()
-	var line string
-	fmt.Fscanln(f, &line)
-	if line != "#requests" {
-		return nil
+	out, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
 	}
-	for {
-		fmt.Fscanln(f, &line)
-		if line == "#end" {
-			return nil
-		}
-		out.WriteString(line[1:] + "\n")
+	if _, err = out.WriteString(deps.String()); err != nil {
+		out.Close()
+		return err
 	}
+	return out.Close()
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// local运行环境忽略编译镜像, 编译型语言不应使用宿主机的工具链编译
+func TestSandboxBuildLocal(t *testing.T) {
+	testSetup(t)
+	l, err := newLocalRuntime(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt = l
+	dir := t.TempDir()
+	if err = ioutil.WriteFile(dir+"/main.go", []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = goBuilder(dir, "main.go"); err != errBuildRuntime {
+		t.Fatalf("goBuilder: %v, want %v", err, errBuildRuntime)
+	}
+	if pathStat(dir+"/main") != notExist {
+		t.Fatal("built with the host toolchain")
+	}
+}
+
+// imageTestMaintain 启动imageMaintain, 测试结束时等待其退出
+func imageTestMaintain(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		imageMaintain()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		ctxRootCancel()
+		<-done
+	})
+}
+
+// imageTestWait 等待该版本的程序镜像更新为ref, 且旧镜像old已删除
+func imageTestWait(t *testing.T, f *fakeRuntime, id programIndex, ref, old string) {
+	t.Helper()
+	ctx := context.Background()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if p, _ := revisionGet(id, 1); p.options.Image == ref && f.ImageExists(ctx, ref) && (old == "" || !f.ImageExists(ctx, old)) {
+			return
+		}
+	}
+	t.Fatalf("image %s not built or %q not removed", ref, old)
+}
+
+// imageTestRun 启动一次运行, 返回其使用的镜像
+func imageTestRun(t *testing.T, f *fakeRuntime, id programIndex) string {
+	t.Helper()
+	runID, err := runStart(id, 0, "", nil, programOptions{}, frameOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := resultGet(runID)
+	spec, ok := f.spec(v.Container)
+	if !ok {
+		t.Fatalf("run %s: no container", runID)
+	}
+	return spec.Image
+}
+
+// 依赖变化后启动仍使用旧镜像, 后台重新构建并删除旧镜像; 镜像缺失时启动立即失败并触发构建
+func TestImageRebuild(t *testing.T) {
+	f, id := processTestSetup(t)
+	f.Hold = false // 构建容器需要退出
+	p, _ := revisionGet(id, 1)
+	old := p.options.Image
+	if old == "" || old != imageRef(p) || !f.ImageExists(context.Background(), old) {
+		t.Fatalf("image %q not built on store", old)
+	}
+	imageTestMaintain(t)
+
+	if err := ioutil.WriteFile(p.dir+"/requirements.txt", []byte("numpy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ref := imageRef(p)
+	if ref == old {
+		t.Fatal("image ref unchanged")
+	}
+	if image := imageTestRun(t, f, id); image != old {
+		t.Fatalf("run image %s, want last good %s", image, old)
+	}
+	imageTestWait(t, f, id, ref, old)
+	if image := imageTestRun(t, f, id); image != ref {
+		t.Fatalf("run image %s, want %s", image, ref)
+	}
+
+	f.ImageRemove(context.Background(), ref)
+	if _, err := runStart(id, 0, "", nil, programOptions{}, frameOrigin{}); err != errImageNotReady {
+		t.Fatalf("runStart: %v, want %v", err, errImageNotReady)
+	}
+	imageTestWait(t, f, id, ref, "")
+	if image := imageTestRun(t, f, id); image != ref {
+		t.Fatalf("run image %s, want %s", image, ref)
+	}
+}
+
+// 依赖声明: 跳过空行, 缺少#end时读到文件末尾, 已有requirements.txt时不覆盖
+func TestResolveDepends(t *testing.T) {
+	for _, c := range []struct {
+		name, src, existing, want string
+	}{
+		{"deps", "#requests\n#numpy\n# pandas==1.0\n#end\nimport numpy\n", "", "numpy\npandas==1.0\n"},
+		{"no end", "#requests\n#numpy\n#requests\n", "", "numpy\nrequests\n"},
+		{"empty line", "#requests\n#numpy\n\n#\n#pandas\n#end\n", "", "numpy\npandas\n"},
+		{"no header", "import os\n#requests\n#numpy\n#end\n", "", ""},
+		{"empty source", "", "", ""},
+		{"existing", "#requests\n#numpy\n#end\n", "flask\n", "flask\n"},
+	} {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(dir+"/main.py", []byte(c.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if c.existing != "" {
+			if err := ioutil.WriteFile(dir+"/requirements.txt", []byte(c.existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := resolveDepends(dir, "main.py"); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if buf, err := ioutil.ReadFile(dir + "/requirements.txt"); err != nil || string(buf) != c.want {
+			t.Errorf("%s: requirements.txt %q %v, want %q", c.name, buf, err, c.want)
+		}
+	}
+}
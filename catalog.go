@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 程序目录: 列出programMapping中的程序, 供后端在故障后核对程序列表
+
+const (
+	catalogLimit    = 100 // 未指定limit时每页的数量
+	catalogLimitMax = 1000
+)
+
+var errCatalogErr = errors.New("Invalid list options")
+
+// programSummary listPrograms返回的一项, 语言、立即推送及大小取自当前版本
+type programSummary struct {
+	ID        programIndex `json:"id"`
+	Language  string       `json:"language"`
+	Immediate bool         `json:"immediate"`
+	Revision  int          `json:"revision"` // 当前版本
+	Size      int64        `json:"size"`     // 上传的源文件或归档的字节数
+	Created   time.Time    `json:"created"`  // 第一个版本的创建时间
+	LastRun   *time.Time   `json:"lastRun,omitempty"`
+	Runs      int64        `json:"runs"`
+}
+
+// programPage listPrograms的一页, Total为过滤后的程序总数
+type programPage struct {
+	Total    int              `json:"total"`
+	Offset   int              `json:"offset"`
+	Programs []programSummary `json:"programs"`
+}
+
+// catalogQuery language可指定多个, 为空时不过滤
+type catalogQuery struct {
+	language map[fileType]bool
+	offset   int
+	limit    int
+}
+
+// catalogParse 解析选项: language(可重复), offset, limit(默认catalogLimit, 最大catalogLimitMax)
+func catalogParse(opt url.Values) (catalogQuery, error) {
+	q := catalogQuery{language: make(map[fileType]bool), limit: catalogLimit}
+	for _, v := range opt["language"] {
+		file, ok := fileTypeParse(v)
+		if !ok {
+			return q, errTypeErr
+		}
+		q.language[file] = true
+	}
+	var err error
+	if v := opt.Get("offset"); v != "" {
+		if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+			return q, errCatalogErr
+		}
+	}
+	if v := opt.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit <= 0 || q.limit > catalogLimitMax {
+			return q, errCatalogErr
+		}
+	}
+	return q, nil
+}
+
+// programList 按创建时间(相同时按ID)升序列出符合条件的程序
+func programList(q catalogQuery) programPage {
+	l := []programSummary{}
+	hashes := []string{}
+	programLock.RLock()
+	for id, e := range programMapping {
+		p := e.revisions[e.current]
+		if len(q.language) > 0 && !q.language[p.file] {
+			continue
+		}
+		v := programSummary{
+			ID:        id,
+			Language:  p.file.String(),
+			Immediate: p.immediate,
+			Revision:  e.current,
+			Created:   p.created,
+			Runs:      e.runs,
+		}
+		for _, r := range e.revisions {
+			if r.created.Before(v.Created) {
+				v.Created = r.created
+			}
+		}
+		if !e.lastRun.IsZero() {
+			t := e.lastRun
+			v.LastRun = &t
+		}
+		l = append(l, v)
+		hashes = append(hashes, p.sourceHash)
+	}
+	programLock.RUnlock()
+	for i := range l {
+		if fi, err := os.Stat(objectPath(hashes[i])); err == nil {
+			l[i].Size = fi.Size()
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].Created.Equal(l[j].Created) {
+			return l[i].Created.Before(l[j].Created)
+		}
+		return l[i].ID < l[j].ID
+	})
+	page := programPage{Total: len(l), Offset: q.offset, Programs: []programSummary{}}
+	if q.offset < len(l) {
+		end := q.offset + q.limit
+		if end > len(l) {
+			end = len(l)
+		}
+		page.Programs = l[q.offset:end]
+	}
+	return page
+}
+
+// programRan 记录程序的一次运行
+func programRan(id programIndex) {
+	programLock.Lock()
+	defer programLock.Unlock()
+	e, ok := programMapping[id]
+	if !ok {
+		return
+	}
+	e.runs++
+	e.lastRun = time.Now()
+	if err := e.store(id); err != nil {
+		logger.Printf("Program: %s: %v.\n", id, err)
+	}
+}
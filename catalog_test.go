@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 语言过滤、offset/limit的边界及空页
+func TestProgramList(t *testing.T) {
+	testSetup(t)
+	created := time.Unix(1600000000, 0)
+	programLock.Lock()
+	for i, file := range []fileType{python3, golang, python3, nodejs, python3} { // 按创建时间依次为P0-P4
+		id := programIndex("P" + string(rune('0'+i)))
+		p := programInfo{id: id, revision: 1, file: file, created: created.Add(time.Duration(i) * time.Second), sourceHash: strings.Repeat("0", 64)}
+		programMapping[id] = &programEntry{current: 1, latest: 1, revisions: map[int]programInfo{1: p}}
+	}
+	programLock.Unlock()
+	for _, c := range []struct {
+		query string
+		want  error
+		total int
+		ids   string
+	}{
+		{"", nil, 5, "P0 P1 P2 P3 P4"},
+		{"language=python3", nil, 3, "P0 P2 P4"},
+		{"language=python3&language=golang", nil, 4, "P0 P1 P2 P4"},
+		{"language=java", nil, 0, ""},
+		{"language=cobol", errTypeErr, 0, ""},
+		{"offset=1&limit=2", nil, 5, "P1 P2"},
+		{"offset=4&limit=2", nil, 5, "P4"},
+		{"offset=5", nil, 5, ""},
+		{"offset=100", nil, 5, ""},
+		{"language=python3&offset=1&limit=1", nil, 3, "P2"},
+		{"language=python3&offset=3", nil, 3, ""},
+		{"limit=1000", nil, 5, "P0 P1 P2 P3 P4"},
+		{"limit=1001", errCatalogErr, 0, ""},
+		{"limit=0", errCatalogErr, 0, ""},
+		{"offset=-1", errCatalogErr, 0, ""},
+		{"offset=x", errCatalogErr, 0, ""},
+	} {
+		opt, _ := url.ParseQuery(c.query)
+		q, err := catalogParse(opt)
+		if err != c.want {
+			t.Errorf("%q: %v, want %v", c.query, err, c.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		page := programList(q)
+		var ids []string
+		for _, v := range page.Programs {
+			ids = append(ids, string(v.ID))
+		}
+		if page.Total != c.total || page.Offset != q.offset || strings.Join(ids, " ") != c.ids {
+			t.Errorf("%q: total %d offset %d programs %v, want %d %q", c.query, page.Total, page.Offset, ids, c.total, c.ids)
+		}
+		if buf, _ := json.Marshal(page); c.ids == "" && !strings.Contains(string(buf), `"programs":[]`) {
+			t.Errorf("%q: empty page %s", c.query, buf)
+		}
+	}
+}
+
+// 摘要中的创建时间为第一个版本的时间, 语言、版本号及大小取自当前版本
+func TestProgramListSummary(t *testing.T) {
+	testSetup(t)
+	first := time.Unix(1600000000, 0)
+	hash, err := objectPut(strings.NewReader("console.log(1)\n"), 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	programLock.Lock()
+	programMapping["P"] = &programEntry{current: 2, latest: 2, runs: 3, lastRun: first.Add(time.Hour), revisions: map[int]programInfo{
+		1: {id: "P", revision: 1, file: python3, created: first, sourceHash: strings.Repeat("0", 64)},
+		2: {id: "P", revision: 2, file: nodejs, immediate: true, created: first.Add(time.Minute), sourceHash: hash},
+	}}
+	programLock.Unlock()
+	page := programList(catalogQuery{limit: catalogLimit})
+	lastRun := first.Add(time.Hour)
+	want := []programSummary{{ID: "P", Language: "nodejs", Immediate: true, Revision: 2, Size: 15, Created: first, LastRun: &lastRun, Runs: 3}}
+	if !reflect.DeepEqual(page.Programs, want) {
+		t.Fatalf("programs %+v, want %+v", page.Programs, want)
+	}
+}
+
+// listPrograms命令: 选项错误时返回statusErr, 否则为长度及JSON
+func TestListProgramsCommand(t *testing.T) {
+	testSetup(t)
+	programLock.Lock()
+	programMapping["P"] = &programEntry{current: 1, latest: 1, revisions: map[int]programInfo{
+		1: {id: "P", revision: 1, file: python3, sourceHash: strings.Repeat("0", 64)},
+	}}
+	programLock.Unlock()
+	server, client := testConnPair(t)
+	for _, c := range []struct {
+		data, want string
+	}{
+		{"", `"total":1`},
+		{"?language=python3&offset=1", `"programs":[]`},
+		{"?language=cobol", string(statusErr)},
+		{"?limit=0", string(statusErr)},
+	} {
+		err := listPrograms(server, []byte(c.data))
+		if (err != nil) != (c.want == string(statusErr)) {
+			t.Errorf("%q: %v", c.data, err)
+		}
+		got := make([]byte, len(statusErr))
+		if c.want != string(statusErr) {
+			head := make([]byte, 4)
+			if _, err = io.ReadFull(client, head); err != nil {
+				t.Fatal(err)
+			}
+			got = make([]byte, binary.BigEndian.Uint32(head))
+		}
+		if _, err = io.ReadFull(client, got); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), c.want) {
+			t.Errorf("%q: %q, want %q", c.data, got, c.want)
+		}
+	}
+}
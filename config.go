@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+const configPath = "config.json"
+
+// duration 以字符串("720h", "30s")表示的时间间隔
+type duration struct {
+	time.Duration
+}
+
+type queueConfig struct {
+	RetentionAge   duration `json:"retentionAge"`   // 已确认的消息保留时间
+	RetentionBytes int64    `json:"retentionBytes"` // 队列占用的最大磁盘空间
+}
+
+type resultConfig struct {
+	MemoryPerRun int64 `json:"memoryPerRun"` // 每个运行在内存中缓存的最大结果大小, 超出后写入磁盘
+	MemoryTotal  int64 `json:"memoryTotal"`  // 所有运行在内存中缓存的最大结果大小
+	MaxSize      int64 `json:"maxSize"`      // 每个运行的最大结果大小, 超出后终止运行
+}
+
+type logConfig struct {
+	TailSize int `json:"tailSize"` // 异常退出时stoped事件中附带的stderr末尾字节数
+}
+
+type buildConfig struct {
+	GoImage   string   `json:"goImage"`   // 编译Go程序的镜像, 固定工具链版本
+	JavaImage string   `json:"javaImage"` // 编译Java程序的镜像(JDK及Maven)
+	CppImage  string   `json:"cppImage"`  // 编译C/C++程序的镜像
+	Timeout   duration `json:"timeout"`   // 编译时间上限
+}
+
+type uploadConfig struct {
+	MaxSize         int64 `json:"maxSize"`         // 上传的源文件或归档的最大大小
+	MaxUnpackedSize int64 `json:"maxUnpackedSize"` // 归档解压后的最大总大小
+	MaxFiles        int   `json:"maxFiles"`        // 归档中的最大文件数
+}
+
+type runConfig struct {
+	Timeout   duration `json:"timeout"`   // 默认的运行时间上限, 0表示不限制
+	StopGrace duration `json:"stopGrace"` // 超时后发送SIGTERM, 等待该时间后SIGKILL
+	Network   string   `json:"network"`   // 默认的网络策略: none, framework, datasource, full
+	// 数据源转发使用的端口范围, 隔离网络的防火墙放行该范围
+	ProxyPortMin int `json:"proxyPortMin"`
+	ProxyPortMax int `json:"proxyPortMax"`
+}
+
+type historyConfig struct {
+	Retention  duration `json:"retention"`  // 运行记录的保留时间, 0表示不限制
+	MaxRecords int      `json:"maxRecords"` // 最多保留的运行记录数
+}
+
+type flowConfig struct {
+	SendWindow int `json:"sendWindow"` // 容器发送结果时的窗口大小
+}
+
+// frameworkConfig 框架配置, 从config.json读取, 未配置的项使用默认值
+type frameworkConfig struct {
+	Queue   queueConfig    `json:"queue"`
+	Flow    flowConfig     `json:"flow"`
+	Result  resultConfig   `json:"result"`
+	Log     logConfig      `json:"log"`
+	Limits  resourceLimits `json:"limits"` // 默认的容器资源限制
+	Run     runConfig      `json:"run"`
+	Runtime runtimeConfig  `json:"runtime"`
+	Build   buildConfig    `json:"build"`
+	Upload  uploadConfig   `json:"upload"`
+	History historyConfig  `json:"history"`
+}
+
+var conf = frameworkConfig{
+	Queue: queueConfig{
+		RetentionAge:   duration{7 * 24 * time.Hour},
+		RetentionBytes: 1 << 30,
+	},
+	Flow: flowConfig{
+		SendWindow: 1 << 20,
+	},
+	Result: resultConfig{
+		MemoryPerRun: 8 << 20,
+		MemoryTotal:  256 << 20,
+		MaxSize:      frameMaxLength - frameHeadMax,
+	},
+	Log: logConfig{
+		TailSize: 4 << 10,
+	},
+	Run: runConfig{
+		StopGrace:    duration{10 * time.Second},
+		Network:      networkFull,
+		ProxyPortMin: 20770,
+		ProxyPortMax: 20869,
+	},
+	Runtime: runtimeConfig{
+		Type: "docker",
+	},
+	Build: buildConfig{
+		GoImage:   "golang:1.15.15",
+		JavaImage: "maven:3.6.3-openjdk-11",
+		CppImage:  "gcc:10",
+		Timeout:   duration{10 * time.Minute},
+	},
+	Upload: uploadConfig{
+		MaxSize:         64 << 20,
+		MaxUnpackedSize: 512 << 20,
+		MaxFiles:        10000,
+	},
+	History: historyConfig{
+		Retention:  duration{30 * 24 * time.Hour},
+		MaxRecords: 100000,
+	},
+}
+
+// confRead 读取配置文件, 文件不存在时使用默认配置
+func confRead(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&conf); err != nil {
+		return err
+	}
+	if conf.Flow.SendWindow <= 0 {
+		return errors.New("flow.sendWindow must be positive")
+	}
+	if conf.Result.MaxSize <= 0 || conf.Result.MaxSize > frameMaxLength-frameHeadMax { // 帧模式下每个结果为一个event frame
+		return errors.New("result.maxSize must be in (0, 256MB - 64KB]")
+	}
+	if err = conf.Limits.check(); err != nil {
+		return err
+	}
+	if conf.Run.Timeout.Duration < 0 || conf.Run.StopGrace.Duration < 0 {
+		return errors.New("run.timeout and run.stopGrace must not be negative")
+	}
+	if conf.Build.Timeout.Duration <= 0 {
+		return errors.New("build.timeout must be positive")
+	}
+	if err = networkCheck(conf.Run.Network, false); err != nil {
+		return err
+	}
+	if conf.Run.ProxyPortMin < 1024 || conf.Run.ProxyPortMin > conf.Run.ProxyPortMax || conf.Run.ProxyPortMax > 65535 {
+		return errors.New("run.proxyPortMin and run.proxyPortMax must be a port range within [1024, 65535]")
+	}
+	if conf.Upload.MaxSize <= 0 || conf.Upload.MaxUnpackedSize <= 0 || conf.Upload.MaxFiles <= 0 {
+		return errors.New("upload.maxSize, upload.maxUnpackedSize and upload.maxFiles must be positive")
+	}
+	if conf.History.Retention.Duration < 0 || conf.History.MaxRecords <= 0 {
+		return errors.New("history.retention must not be negative and history.maxRecords must be positive")
+	}
+	if conf.Log.TailSize < 0 {
+		return errors.New("log.tailSize must not be negative")
+	}
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
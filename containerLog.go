@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 容器的stdout/stderr写入storePath/.logs/<运行ID>.stdout(.stderr), 与运行记录(见runHistory.go)一同删除
+// 按行以stdout、stderr事件实时推送给订阅者(不写入消息队列)
+
+const (
+	logStdout  = "stdout"
+	logStderr  = "stderr"
+	logLineMax = 4096 // 超出该长度的行拆分推送
+)
+
+// runLog 一个运行的日志采集
+type runLog struct {
+	done   chan struct{}
+	stdout *logWriter
+	stderr *logWriter
+}
+
+// logWriter 写入日志文件并按行推送, stderr保留最后conf.Log.TailSize字节
+type logWriter struct {
+	program programIndex
+	run     string
+	stream  string
+	file    *os.File
+	line    []byte
+	tail    []byte
+	lock    sync.Mutex
+}
+
+func logPath(runID, stream string) string {
+	return storePath + "/.logs/" + runID + "." + stream
+}
+
+// logCapture 开始采集容器containerID的日志, 按运行runID保存及推送, 容器退出或ctx取消后结束
+func logCapture(ctx context.Context, runID, containerID string, program programIndex) *runLog {
+	l := &runLog{
+		done:   make(chan struct{}),
+		stdout: newLogWriter(runID, program, logStdout),
+		stderr: newLogWriter(runID, program, logStderr),
+	}
+	go func() {
+		defer close(l.done)
+		defer l.stdout.Close()
+		defer l.stderr.Close()
+		if err := rt.Logs(ctx, containerID, l.stdout, l.stderr); err != nil && ctx.Err() == nil {
+			logger.Printf("Container: %s logs: %v.\n", containerID, err)
+		}
+	}()
+	return l
+}
+
+// wait 等待采集结束, 返回stderr的末尾部分
+func (l *runLog) wait(timeout time.Duration) string {
+	select {
+	case <-l.done:
+	case <-time.After(timeout):
+		logger.Printf("Run: %s logs not finished.\n", l.stderr.run)
+	}
+	return l.stderr.Tail()
+}
+
+func newLogWriter(runID string, program programIndex, stream string) *logWriter {
+	w := &logWriter{program: program, run: runID, stream: stream}
+	if err := os.MkdirAll(storePath+"/.logs", 0755); err != nil {
+		logger.Println(err)
+		return w
+	}
+	f, err := os.OpenFile(logPath(runID, stream), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		logger.Println(err)
+		return w
+	}
+	w.file = f
+	return w
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file != nil {
+		if _, err := w.file.Write(p); err != nil {
+			logger.Println(err)
+			w.file.Close()
+			w.file = nil
+		}
+	}
+	if w.stream == logStderr {
+		w.tail = append(w.tail, p...)
+		if n := len(w.tail) - conf.Log.TailSize; n > 0 {
+			w.tail = append(w.tail[:0], w.tail[n:]...)
+		}
+	}
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			if len(w.line) >= logLineMax {
+				i = logLineMax
+			} else {
+				break
+			}
+		}
+		w.publish(w.line[:i])
+		if i < len(w.line) && w.line[i] == '\n' {
+			i++
+		}
+		w.line = w.line[i:]
+	}
+	return len(p), nil
+}
+
+func (w *logWriter) publish(line []byte) {
+	eventPublish(runEvent{
+		Type:    w.stream,
+		Program: w.program,
+		Run:     w.run,
+		Message: string(bytes.TrimSuffix(line, []byte{'\r'})),
+		Time:    time.Now(),
+	})
+}
+
+// Close 推送剩余的不完整行并关闭文件
+func (w *logWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.line) > 0 {
+		w.publish(w.line)
+		w.line = nil
+	}
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *logWriter) Tail() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return string(w.tail)
+}
+
+// logGet 读取运行的日志, stream: stdout, stderr
+func logGet(runID, stream string) ([]byte, error) {
+	if stream != logStdout && stream != logStderr {
+		return nil, errTypeErr
+	}
+	if _, ok := historyGet(runID); !ok {
+		if _, ok = resultGet(runID); !ok {
+			return nil, errNoID
+		}
+	}
+	return ioutil.ReadFile(logPath(runID, stream))
+}
+
+func logRemove(runID string) {
+	os.Remove(logPath(runID, logStdout))
+	os.Remove(logPath(runID, logStderr))
+}
+
+// logSweep 启动时删除没有运行记录的日志文件(运行记录已过期或删除日志前框架退出)
+func logSweep() {
+	files, err := ioutil.ReadDir(storePath + "/.logs")
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		runID := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+		if _, ok := historyGet(runID); !ok {
+			os.Remove(storePath + "/.logs/" + fi.Name())
+		}
+	}
+}
@@ -1,90 +1,285 @@
 package main
 
 import (
-	"context"
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"sync"
+	"time"
 )
 
+// runResult 运行结果, 供REST接口按运行ID查询, 结果数据从消息队列中读取
+type runResult struct {
+	ID        string       `json:"id"`
+	Program   programIndex `json:"program"`
+	Revision  int          `json:"revision"`  // 启动时使用的程序版本
+	Container string       `json:"container"` // 容器运行时的ID, 仅供排查问题
+	Status    string       `json:"status"`
+	Code      int64        `json:"code"`
+	Reason    string       `json:"reason,omitempty"`
+	Stderr    string       `json:"stderr,omitempty"` // 异常退出时stderr的末尾部分
+	Size      int64        `json:"size"`
+	Outputs   []runOutput  `json:"outputs"`
+	Start     time.Time    `json:"start"`
+	End       *time.Time   `json:"end,omitempty"`
+}
+
+// runOutput 运行的一个输出, Name为空表示默认输出
+type runOutput struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	dataSeq     []uint64
+}
+
+// dataBuffer 一个输出的缓存, 超出内存限制后写入磁盘
+type dataBuffer struct {
+	contentType string
+	mem         []byte
+	file        *os.File
+	size        int64
+}
+
+// runBuffer 非立即推送程序的结果缓存, 按输出名称区分
+type runBuffer struct {
+	outputs map[string]*dataBuffer
+	order   []string
+	mem     int64
+	size    int64
+	failed  bool
+}
+
+// dataOutput 运行结束后读取的一个输出
+type dataOutput struct {
+	name        string
+	contentType string
+	body        io.ReadCloser
+	size        int64
+}
+
+// spillReader 关闭时删除缓存文件
+type spillReader struct {
+	*os.File
+}
+
 var (
-	dataMapping     = make(map[string][]byte)
-	dataMappingLock = sync.Mutex{}
-	py2File         = []byte{0}
-	py3File         = []byte{1}
-	goFile          = []byte{2}
+	errResultTooLarge = errors.New("Result too large")
+	dataMapping       = make(map[string]*runBuffer)
+	dataMappingLock   = sync.Mutex{}
+	dataMemory        int64 // 所有运行在内存中缓存的结果大小
+	resultMapping     = make(map[string]*runResult)
+	resultLock        = sync.RWMutex{}
+	resultTTL         = time.Hour // 运行结束后结果保留的时间
 )
 
-func dataStore(containerID string, data []byte) {
+// dataStore 缓存名称为name的输出, data为nil时仅创建该运行的缓存
+// 超出conf.Result.MaxSize时返回errResultTooLarge, 该运行应被终止
+func dataStore(runID, name, contentType string, data []byte) error {
 	dataMappingLock.Lock()
-	if v, ok := dataMapping[containerID]; ok {
-		dataMapping[containerID] = append(v, data...)
+	defer dataMappingLock.Unlock()
+	r, ok := dataMapping[runID]
+	if !ok {
+		r = &runBuffer{outputs: make(map[string]*dataBuffer)}
+		dataMapping[runID] = r
+	}
+	if data == nil {
+		return nil
+	}
+	length := int64(len(data))
+	if r.failed {
+		return errResultTooLarge
+	}
+	if r.size+length > conf.Result.MaxSize {
+		r.failed = true
+		return errResultTooLarge
+	}
+	v, ok := r.outputs[name]
+	if !ok {
+		v = &dataBuffer{}
+		r.outputs[name] = v
+		r.order = append(r.order, name)
+	}
+	if contentType != "" {
+		v.contentType = contentType
+	}
+	if v.file == nil && (r.mem+length > conf.Result.MemoryPerRun ||
+		dataMemory+length > conf.Result.MemoryTotal) {
+		if err := v.spill(runID); err != nil {
+			return err
+		}
+		r.mem -= int64(len(v.mem))
+		v.mem = nil
+	}
+	if v.file != nil {
+		if _, err := v.file.Write(data); err != nil {
+			return err
+		}
 	} else {
-		dataMapping[containerID] = data
+		v.mem = append(v.mem, data...)
+		r.mem += length
+		dataMemory += length
+	}
+	v.size += length
+	r.size += length
+	return nil
+}
+
+// spill 将内存中的结果写入storePath/.spill下以runID为前缀的新文件, 需持有dataMappingLock
+func (v *dataBuffer) spill(runID string) error {
+	dir := storePath + "/.spill"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, runID+"-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(v.mem); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	dataMemory -= int64(len(v.mem))
+	v.file = f
+	return nil
+}
+
+// dataFail 标记该运行的结果超出限制, 丢弃已缓存的结果
+func dataFail(runID string) {
+	dataMappingLock.Lock()
+	r, ok := dataMapping[runID]
+	if !ok {
+		r = &runBuffer{outputs: make(map[string]*dataBuffer)}
+		dataMapping[runID] = r
 	}
+	r.failed = true
 	dataMappingLock.Unlock()
 }
 
-// Read Data and remove the mapping
-func dataRead(containerID string) []byte {
+// dataRead 按写入顺序读取所有输出并删除缓存, 调用者需关闭各输出的body
+func dataRead(runID string) (outputs []dataOutput, failed bool) {
 	dataMappingLock.Lock()
 	defer dataMappingLock.Unlock()
-	if v, ok := dataMapping[containerID]; ok {
-		delete(dataMapping, containerID)
-		return v
+	r, ok := dataMapping[runID]
+	if !ok {
+		return nil, false
 	}
-	return nil
+	delete(dataMapping, runID)
+	dataMemory -= r.mem
+	for _, name := range r.order {
+		v := r.outputs[name]
+		out := dataOutput{name: name, contentType: v.contentType, size: v.size}
+		if v.file != nil {
+			if _, err := v.file.Seek(0, io.SeekStart); r.failed || err != nil {
+				v.file.Close()
+				os.Remove(v.file.Name())
+				continue
+			}
+			out.body = spillReader{v.file}
+		} else {
+			out.body = ioutil.NopCloser(bytes.NewReader(v.mem))
+		}
+		if !r.failed {
+			outputs = append(outputs, out)
+		}
+	}
+	return outputs, r.failed
 }
 
-func (p programInfo) cfgStore() error {
-	f, err := os.OpenFile(p.dir+"/status", os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+// spillSweep 启动时删除上次运行遗留的缓存文件, 其运行已无法继续
+func spillSweep() {
+	os.RemoveAll(storePath + "/.spill")
+}
+
+func (r spillReader) Close() error {
+	err := r.File.Close()
+	os.Remove(r.Name())
+	return err
+}
+
+func resultInit(runID, containerID string, program programIndex, revision int) {
+	resultLock.Lock()
+	resultMapping[runID] = &runResult{
+		ID:        runID,
+		Program:   program,
+		Revision:  revision,
+		Container: containerID,
+		Status:    "running",
+		Start:     time.Now(),
+	}
+	resultLock.Unlock()
+}
+
+// resultAppend 记录输出消息的序号
+func resultAppend(runID, name, contentType string, seq uint64, size int64) {
+	resultLock.Lock()
+	defer resultLock.Unlock()
+	v, ok := resultMapping[runID]
+	if !ok {
+		return
 	}
-	switch p.file {
-	case python2:
-		f.Write(py2File)
-	case python3:
-		f.Write(py3File)
-	case golang:
-		f.Write(goFile)
+	v.Size += size
+	for i := range v.Outputs {
+		if v.Outputs[i].Name == name {
+			v.Outputs[i].dataSeq = append(v.Outputs[i].dataSeq, seq)
+			v.Outputs[i].Size += size
+			return
+		}
 	}
-	if p.immediate {
-		f.Write([]byte{1})
-	} else {
-		f.Write([]byte{0})
+	v.Outputs = append(v.Outputs, runOutput{
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		dataSeq:     []uint64{seq},
+	})
+}
+
+// resultDone 记录运行结束, 结果在resultTTL后删除
+func resultDone(runID string, code int64, reason, stderr string) {
+	resultLock.Lock()
+	if v, ok := resultMapping[runID]; ok {
+		now := time.Now()
+		v.Status = "stoped"
+		v.Code = code
+		v.Reason = reason
+		v.Stderr = stderr
+		v.End = &now
 	}
-	f.Close()
-	return err
+	resultLock.Unlock()
+	time.AfterFunc(resultTTL, func() {
+		resultRemove(runID)
+	})
 }
 
-func (p *programInfo) cfgLoader(dir string) error {
-	f, err := os.Open(dir + "/status")
-	if err != nil {
-		return err
+// resultRemove 删除内存中的运行结果, 运行记录及日志仍保留至history.retention
+func resultRemove(runID string) {
+	resultLock.Lock()
+	delete(resultMapping, runID)
+	resultLock.Unlock()
+}
+
+// resultGet 获取运行结果的副本
+func resultGet(runID string) (runResult, bool) {
+	resultLock.RLock()
+	defer resultLock.RUnlock()
+	if v, ok := resultMapping[runID]; ok {
+		r := *v
+		r.Outputs = make([]runOutput, len(v.Outputs))
+		for i := range v.Outputs {
+			r.Outputs[i] = v.Outputs[i]
+			r.Outputs[i].dataSeq = append([]uint64(nil), v.Outputs[i].dataSeq...)
+		}
+		return r, true
 	}
-	p.dir = dir
-	buf := make([]byte, 2)
-	f.Read(buf)
-	f.Close()
-	switch buf[0] {
-	case 0:
-		p.file = python2
-	case 1:
-		p.file = python3
-	case 2:
-		p.file = golang
-	}
-	if buf[1] == 1 {
-		p.immediate = true
-	}
-	p.ctx, p.cancel = context.WithCancel(ctxRoot)
-	return err
+	return runResult{}, false
 }
 
 // IDReader 初始化时获取programInfo
-func IDReader(mapping map[programIndex]programInfo) {
+// 旧的目录结构转换为版本1, 旧格式的status文件转换为manifest.json
+func IDReader(mapping map[programIndex]*programEntry) {
 	if mapping == nil {
 		return
 	}
@@ -92,14 +287,21 @@ func IDReader(mapping map[programIndex]programInfo) {
 	if err != nil {
 		logger.Println(err)
 	}
-	p := &programInfo{}
 	for i := range files {
 		name := files[i].Name()
-		err = p.cfgLoader(storePath + "/" + name)
+		if name[0] == '.' || !files[i].IsDir() { // .queue etc.
+			continue
+		}
+		dir := storePath + "/" + name
+		if err = programMigrate(dir); err != nil {
+			log.Println(err)
+			continue
+		}
+		e, err := programLoad(dir)
 		if err != nil {
 			log.Println(err)
-		} else {
-			mapping[programIndex(name)] = *p
+			continue
 		}
+		mapping[programIndex(name)] = e
 	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// 两个输出先后超出内存限制时各自写入不同的缓存文件
+func TestDataSpillPerOutput(t *testing.T) {
+	testSetup(t)
+	memory := conf.Result.MemoryPerRun
+	conf.Result.MemoryPerRun = 4
+	defer func() { conf.Result.MemoryPerRun = memory }()
+	for _, v := range []struct{ name, data string }{
+		{"a", "aaaa"}, {"b", "bbbb"}, {"a", "AAAA"}, {"b", "BBBB"},
+	} {
+		if err := dataStore("R", v.name, "", []byte(v.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outputs, failed := dataRead("R")
+	if failed || len(outputs) != 2 {
+		t.Fatalf("failed %v, %d outputs", failed, len(outputs))
+	}
+	want := map[string]string{"a": "aaaaAAAA", "b": "bbbbBBBB"}
+	for _, out := range outputs {
+		b, err := ioutil.ReadAll(out.body)
+		out.body.Close()
+		if err != nil || string(b) != want[out.name] || out.size != int64(len(b)) {
+			t.Fatalf("output %s: %q (size %d), %v", out.name, b, out.size, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(storePath + "/.spill"); len(files) != 0 {
+		t.Fatalf("%d spill files left", len(files))
+	}
+}
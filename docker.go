@@ -4,15 +4,19 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/moby/moby/client"
 )
 
@@ -20,7 +24,8 @@ import (
 type PathType byte
 
 const (
-	execDocker = "/usr/bin/docker"
+	execDocker      = "/usr/bin/docker"
+	isolatedNetwork = "aaf-isolated"
 )
 
 const (
@@ -29,142 +34,227 @@ const (
 	file
 )
 
+// dockerRuntime 以Docker容器运行程序
+type dockerRuntime struct {
+	cli *client.Client
+}
+
 var (
 	imageMapping = map[fileType]string{
 		python2: "registry-vpc.cn-shanghai.aliyuncs.com/yin199909/centos_7:origin",
 		python3: "registry-vpc.cn-shanghai.aliyuncs.com/yin199909/centos_7:python3",
 		golang:  "registry-vpc.cn-shanghai.aliyuncs.com/yin199909/centos_7:origin",
+		nodejs:  "node:14",
+		java:    "openjdk:11-jre-slim",
+		cpp:     "gcc:10",
 	}
 	errNotSupport = errors.New("Path type not support")
+	networkLock   = sync.Mutex{}
+	isolatedGW    string     // 隔离网络的网关, 即容器访问框架的地址
+	isolatedNet   *net.IPNet // 来自隔离网络的连接不能访问:443及REST接口
 )
 
-func dockerRunCmd(file fileType, dir string) error {
-	ctx := context.Background()
+func newDockerRuntime() (*dockerRuntime, error) {
 	cli, err := client.NewEnvClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer cli.Close()
-	cmd := []string{"sh", "-c"}
-	switch file {
-	case python2:
-		cmd = append(cmd, "pip2 install -r requirements.txt && pylint --output-format=json --errors-only main.py")
-	case python3:
-		cmd = append(cmd, "pip3 install -r requirements.txt && pylint --output-format=json --errors-only main.py")
-	default:
-		return nil
+	return &dockerRuntime{cli: cli}, nil
+}
+
+// Network none: 无网络; full: 默认bridge网络; framework, datasource: 隔离网络
+func (d *dockerRuntime) Network(ctx context.Context, policy string) (string, error) {
+	switch policy {
+	case networkNone:
+		return "", nil
+	case networkFull:
+		gateway := "172.17.0.1"
+		if res, err := d.cli.NetworkInspect(ctx, "bridge"); err == nil && len(res.IPAM.Config) > 0 && res.IPAM.Config[0].Gateway != "" {
+			gateway = res.IPAM.Config[0].Gateway
+		}
+		return gateway, nil
+	case networkFramework, networkDatasource:
+		return isolatedEnsure(ctx, d.cli)
 	}
-	body, err := cli.ContainerCreate(ctx, &container.Config{
-		Image:      imageMapping[file],
-		Cmd:        cmd,
-		WorkingDir: "/app",
-	}, nil, nil, "")
+	return "", errNetworkErr
+}
+
+func (d *dockerRuntime) Create(ctx context.Context, spec containerSpec) (string, error) {
+	hostConfig, err := spec.Limits.hostConfig()
 	if err != nil {
-		return nil
+		return "", err
 	}
-	defer cli.ContainerRemove(ctx, body.ID, types.ContainerRemoveOptions{Force: true})
-	if err = copyToContainer(ctx, cli, body.ID, "/app/", dir); err != nil {
-		return err
+	switch spec.Network {
+	case networkNone:
+		hostConfig.NetworkMode = "none"
+	case networkFramework, networkDatasource:
+		hostConfig.NetworkMode = isolatedNetwork
+	default:
+		hostConfig.NetworkMode = "bridge"
 	}
-	if err = cli.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
-		return err
+	body, err := d.cli.ContainerCreate(ctx, &container.Config{
+		Image:      spec.Image,
+		Cmd:        spec.Cmd,
+		Env:        spec.Env,
+		WorkingDir: spec.WorkingDir,
+	}, hostConfig, nil, "")
+	if err != nil {
+		return "", err
 	}
-	returnCode, err := cli.ContainerWait(ctx, body.ID)
+	return body.ID, nil
+}
+
+func (d *dockerRuntime) CopyIn(ctx context.Context, id, dst, src string) error {
+	return copyToContainer(ctx, d.cli, id, dst, src)
+}
+
+func (d *dockerRuntime) CopyOut(ctx context.Context, id, src, dst string) error {
+	r, _, err := d.cli.CopyFromContainer(ctx, id, src)
 	if err != nil {
 		return err
 	}
-	if returnCode != 0 {
-		r, _ := cli.ContainerLogs(ctx, body.ID, types.ContainerLogsOptions{ShowStderr: true})
-		msg, _ := ioutil.ReadAll(r)
-		return execErr{
-			cmd:     "docker check code",
-			errMsg:  string(msg),
-			errCode: int(returnCode),
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(dst, filepath.Base(hdr.Name)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return nil
 }
 
-func newProcess(ctxRoot context.Context, p programInfo, argv string, dbList []dbInfo) (string, error) {
-	ctx, cancel := context.WithCancel(ctxRoot)
-	cli, err := client.NewEnvClient()
+func (d *dockerRuntime) Start(ctx context.Context, id string) error {
+	return d.cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (d *dockerRuntime) Wait(ctx context.Context, id string) (int64, error) {
+	return d.cli.ContainerWait(ctx, id)
+}
+
+func (d *dockerRuntime) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	r, err := d.cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
 	if err != nil {
-		cancel()
-		return "", err
+		return err
+	}
+	defer r.Close()
+	_, err = stdcopy.StdCopy(stdout, stderr, r)
+	return err
+}
+
+func (d *dockerRuntime) Kill(ctx context.Context, id string, grace time.Duration) error {
+	return d.cli.ContainerStop(ctx, id, &grace)
+}
+
+func (d *dockerRuntime) Remove(ctx context.Context, id string) error {
+	return d.cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+}
+
+func (d *dockerRuntime) Commit(ctx context.Context, id, ref string) error {
+	_, err := d.cli.ContainerCommit(ctx, id, types.ContainerCommitOptions{Reference: ref})
+	return err
+}
+
+func (d *dockerRuntime) ImageExists(ctx context.Context, ref string) bool {
+	_, _, err := d.cli.ImageInspectWithRaw(ctx, ref)
+	return err == nil
+}
+
+func (d *dockerRuntime) ImageRemove(ctx context.Context, ref string) error {
+	_, err := d.cli.ImageRemove(ctx, ref, types.ImageRemoveOptions{Force: true, PruneChildren: true})
+	return err
+}
+
+func (d *dockerRuntime) Stats(ctx context.Context, id string) (containerStats, error) {
+	info, err := d.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return containerStats{}, err
+	}
+	s := containerStats{}
+	if info.State != nil {
+		s.Running = info.State.Running
+		s.OOMKilled = info.State.OOMKilled
+	}
+	if !s.Running { // 已退出的容器没有资源使用数据
+		return s, nil
+	}
+	r, err := d.cli.ContainerStats(ctx, id, false)
+	if err != nil {
+		return s, nil
+	}
+	defer r.Body.Close()
+	stats := types.StatsJSON{}
+	if json.NewDecoder(r.Body).Decode(&stats) == nil {
+		s.MemoryUsage = int64(stats.MemoryStats.Usage)
+		s.MemoryPeak = int64(stats.MemoryStats.MaxUsage)
+		s.CPUTime = time.Duration(stats.CPUStats.CPUUsage.TotalUsage)
+	}
+	return s, nil
+}
+
+func isolatedEnsure(ctx context.Context, cli *client.Client) (string, error) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	if isolatedGW != "" {
+		return isolatedGW, nil
+	}
+	res, err := cli.NetworkInspect(ctx, isolatedNetwork)
+	if client.IsErrNetworkNotFound(err) {
+		_, err = cli.NetworkCreate(ctx, isolatedNetwork, types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         "bridge",
+			Internal:       true,
+			Options:        map[string]string{"com.docker.network.bridge.enable_icc": "false"},
+		})
+		if err != nil {
+			return "", err
+		}
+		res, err = cli.NetworkInspect(ctx, isolatedNetwork)
 	}
-	sess := sessionIDGen(16)
-	cmd := []string{"sh", "-c"}
-	switch p.file {
-	case python2:
-		cmd = append(cmd, fmt.Sprintf("pip2 install -r requirements.txt && python2 main.py %s %s", sess, argv))
-	case python3:
-		cmd = append(cmd, fmt.Sprintf("pip3 install -r requirements.txt && python3 main.py %s %s", sess, argv))
-	case golang:
-		cmd = append(cmd, fmt.Sprintf("./main %s %s", sess, argv))
-	}
-	body, err := cli.ContainerCreate(ctx, &container.Config{
-		Image:      imageMapping[p.file],
-		Cmd:        cmd,
-		WorkingDir: "/app",
-	}, nil, nil, "")
 	if err != nil {
-		cli.Close()
-		cancel()
 		return "", err
 	}
-	if err = copyToContainer(ctx, cli, body.ID, "/app/", p.dir); err != nil {
-		cli.ContainerRemove(context.Background(), body.ID, types.ContainerRemoveOptions{Force: true})
-		cli.Close()
-		cancel()
+	if len(res.IPAM.Config) == 0 || res.IPAM.Config[0].Gateway == "" {
+		return "", fmt.Errorf("network %s has no gateway", isolatedNetwork)
+	}
+	_, subnet, err := net.ParseCIDR(res.IPAM.Config[0].Subnet)
+	if err != nil {
 		return "", err
 	}
-	containerSessToID[sess] = body.ID
-	dbListMapping[body.ID] = dbList
-	processMapping[body.ID] = processInfo{cancel: cancel, immediate: p.immediate}
-	if p.immediate == false {
-		dataStore(body.ID, nil)
-	}
-	if err = cli.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
-		cli.ContainerRemove(context.Background(), body.ID, types.ContainerRemoveOptions{Force: true})
-		cli.Close()
-		cancel()
-		delete(containerSessToID, sess)
-		delete(processMapping, body.ID)
-		dataRead(body.ID)
-		dbInfoRemove(body.ID)
+	if err = firewallEnsure(subnet); err != nil { // 未能限制对宿主机的访问时不使用该网络
 		return "", err
 	}
-	go containerListenAndServe(ctx, cli, body.ID, sess, p)
-	return body.ID, nil
+	isolatedGW, isolatedNet = res.IPAM.Config[0].Gateway, subnet
+	return isolatedGW, nil
 }
-
-func containerListenAndServe(ctx context.Context, cli *client.Client, containerID string, sess sessionID, p programInfo) {
-	returnCode, err := cli.ContainerWait(ctx, containerID)
-	logger.Printf("Container: %s return %d.\n", containerID, returnCode)
+func networkIsolated(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		logger.Printf("Exit with error: %s.\n", err.Error())
-	}
-	data := dataRead(containerID)
-
-	// // read stdout
-	// r, _ := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{ShowStdout: true})
-	// d, _ := ioutil.ReadAll(r)
-	// fmt.Println(string(d))
-
-	mqLock.Lock() // 互斥锁上锁
-	mqSend([]byte(fmt.Sprintf("stoped:%s:%d\x00", containerID, returnCode)))
-	if data != nil {
-		lengthBuf := int32Encoder(int32(len(data)))
-		mqSend([]byte(fmt.Sprintf("data:%s\x00", containerID)))
-		mqSend(lengthBuf)
-		mqSend(data)
-	}
-	mqLock.Unlock() // 互斥锁解锁
-	cli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true})
-	dbInfoRemove(containerID)
-	processCancel(containerID)
-	cli.Close()
-	delete(containerSessToID, sess)
+		return false
+	}
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	return isolatedNet != nil && isolatedNet.Contains(net.ParseIP(host))
 }
 
 func copyToContainer(ctx context.Context, cli *client.Client, containerID, dst, src string) error {
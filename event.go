@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// runEvent 运行结果事件, 推送到listener及所有订阅者
+// 较大的结果通过body流式写入消息队列, 此时Data为空, 订阅者可通过REST接口获取
+type runEvent struct {
+	Seq         uint64       `json:"seq"`
+	Type        string       `json:"type"` // stoped, data, progress, log, stdout, stderr
+	Program     programIndex `json:"program"`
+	Run         string       `json:"run"` // 运行ID
+	Code        int64        `json:"code"`
+	Reason      string       `json:"reason,omitempty"` // 非正常退出的原因
+	Stderr      string       `json:"stderr,omitempty"` // 异常退出时stderr的末尾部分
+	Name        string       `json:"name,omitempty"`   // 输出名称, 为空表示默认输出
+	ContentType string       `json:"contentType,omitempty"`
+	Size        int64        `json:"size,omitempty"`
+	Progress    float64      `json:"progress,omitempty"` // 0-100
+	Level       string       `json:"level,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	Data        []byte       `json:"data,omitempty"`
+	Time        time.Time    `json:"time"`
+	body        io.Reader
+}
+
+// stoped event reason
+const (
+	reasonResultTooLarge = "resultTooLarge"
+	reasonOOM            = "oom"     // 超出内存限制被终止
+	reasonTimeout        = "timeout" // 超出运行时间上限被终止
+)
+
+// eventFilter 为空的字段不参与过滤
+type eventFilter struct {
+	program programIndex
+	run     string
+}
+
+type eventSubscriber struct {
+	filter eventFilter
+	ch     chan runEvent
+}
+
+const subscriberBuffer = 64
+
+var (
+	subscriberMapping = make(map[*eventSubscriber]struct{})
+	subscriberLock    = sync.RWMutex{}
+)
+
+// eventSend 将事件写入消息队列(listener)并发布给订阅者
+func eventSend(ev runEvent, origin frameOrigin) {
+	ev.Time = time.Now()
+	if ev.body == nil {
+		ev.Size = int64(len(ev.Data))
+	}
+	seq, err := mqSend(ev, origin)
+	if err != nil {
+		logger.Printf("Queue write: %v.\n", err)
+		return
+	}
+	ev.Seq = seq
+	ev.body = nil
+	if ev.Type == "data" {
+		resultAppend(ev.Run, ev.Name, ev.ContentType, seq, ev.Size)
+	}
+	eventPublish(ev)
+}
+
+// legacyHead 原协议格式, 结果数据(Size bytes)紧随其后
+// stoped: "stoped:" + runID + ":" + (exit code or reason) + "\x00"
+// 异常退出: "stoped:" + runID + ":" + (exit code or reason) + ":" + stderr末尾(URL编码) + "\x00"
+// data: "data:" + runID + "\x00" + length(4 bytes)
+// 命名的输出: "output:" + runID + ":" + name + ":" + contentType + "\x00" + length(4 bytes), name与contentType经过URL编码
+// progress: "progress:" + runID + ":" + percent + ":" + message(URL编码) + "\x00"
+// log: "log:" + runID + ":" + level + ":" + text(URL编码) + "\x00"
+func (ev runEvent) legacyHead() []byte {
+	switch ev.Type {
+	case "stoped":
+		head := fmt.Sprintf("stoped:%s:%d", ev.Run, ev.Code)
+		if ev.Reason != "" {
+			head = fmt.Sprintf("stoped:%s:%s", ev.Run, ev.Reason)
+		}
+		if ev.Stderr != "" {
+			head += ":" + url.QueryEscape(ev.Stderr)
+		}
+		return []byte(head + "\x00")
+	case "data":
+		if ev.Name != "" {
+			head := fmt.Sprintf("output:%s:%s:%s\x00", ev.Run, url.QueryEscape(ev.Name), url.QueryEscape(ev.ContentType))
+			return append([]byte(head), int32Encoder(int32(ev.Size))...)
+		}
+		return append([]byte("data:"+ev.Run+"\x00"), int32Encoder(int32(ev.Size))...)
+	case "progress":
+		return []byte(fmt.Sprintf("progress:%s:%g:%s\x00", ev.Run, ev.Progress, url.QueryEscape(ev.Message)))
+	case "log":
+		return []byte(fmt.Sprintf("log:%s:%s:%s\x00", ev.Run, ev.Level, url.QueryEscape(ev.Message)))
+	}
+	return nil
+}
+
+// runFilter 按运行ID过滤, 兼容旧的参数名container
+func runFilter(q url.Values) string {
+	if v := q.Get("run"); v != "" {
+		return v
+	}
+	return q.Get("container")
+}
+
+func (f eventFilter) match(ev runEvent) bool {
+	if f.program != "" && f.program != ev.Program {
+		return false
+	}
+	if f.run != "" && f.run != ev.Run {
+		return false
+	}
+	return true
+}
+
+func eventSubscribe(filter eventFilter) *eventSubscriber {
+	sub := &eventSubscriber{
+		filter: filter,
+		ch:     make(chan runEvent, subscriberBuffer),
+	}
+	subscriberLock.Lock()
+	subscriberMapping[sub] = struct{}{}
+	subscriberLock.Unlock()
+	return sub
+}
+
+func eventUnsubscribe(sub *eventSubscriber) {
+	subscriberLock.Lock()
+	if _, ok := subscriberMapping[sub]; ok {
+		delete(subscriberMapping, sub)
+		close(sub.ch)
+	}
+	subscriberLock.Unlock()
+}
+
+// eventPublish 不阻塞发布者, 缓冲区已满时丢弃容器输出(stdout, stderr)的行,
+// 其他事件(已写入消息队列)无法放入时移除该订阅者, 订阅者可以最后收到的序号(SSE id)重新订阅
+func eventPublish(ev runEvent) {
+	var slow []*eventSubscriber
+	subscriberLock.RLock()
+	for sub := range subscriberMapping {
+		if !sub.filter.match(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			if ev.Seq != 0 {
+				slow = append(slow, sub)
+			}
+		}
+	}
+	subscriberLock.RUnlock()
+	for _, sub := range slow {
+		logger.Printf("Subscriber too slow, removed.\n")
+		eventUnsubscribe(sub)
+	}
+}
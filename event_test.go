@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 缓冲区已满时只丢弃容器输出, 消息队列中的事件无法放入时移除订阅者
+func TestEventPublishFull(t *testing.T) {
+	testSetup(t)
+	sub := eventSubscribe(eventFilter{})
+	defer eventUnsubscribe(sub)
+	for i := 0; i < 2*subscriberBuffer; i++ {
+		eventPublish(runEvent{Type: logStdout, Run: "R", Message: "line"})
+	}
+	subscriberLock.RLock()
+	_, ok := subscriberMapping[sub]
+	subscriberLock.RUnlock()
+	if !ok || len(sub.ch) != subscriberBuffer {
+		t.Fatalf("subscribed %v, buffered %d", ok, len(sub.ch))
+	}
+	eventPublish(runEvent{Seq: 1, Type: "progress", Run: "R"})
+	subscriberLock.RLock()
+	_, ok = subscriberMapping[sub]
+	subscriberLock.RUnlock()
+	if ok {
+		t.Fatal("slow subscriber not removed")
+	}
+}
+
+// sseTestID 读取下一个事件的id
+func sseTestID(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			return strings.TrimSpace(line[4:])
+		}
+	}
+}
+
+// 以Last-Event-ID重新订阅时从消息队列重放之后的事件, 之后继续实时推送
+func TestRestEventsResume(t *testing.T) {
+	testSetup(t)
+	mqReopen(t, t.TempDir())
+	for i := 0; i < 3; i++ {
+		eventSend(runEvent{Type: "progress", Run: "R", Progress: float64(i)}, frameOrigin{})
+	}
+	eventSend(runEvent{Type: "progress", Run: "other"}, frameOrigin{})
+	srv := httptest.NewServer(http.HandlerFunc(restEvents))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?run=R", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	r := bufio.NewReader(res.Body)
+	for _, want := range []string{"2", "3"} {
+		if id := sseTestID(t, r); id != want {
+			t.Fatalf("replayed id %s, want %s", id, want)
+		}
+	}
+	eventSend(runEvent{Type: "progress", Run: "R"}, frameOrigin{})
+	if id := sseTestID(t, r); id != "5" {
+		t.Fatalf("live id %s, want 5", id)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fakeRuntime 内存中的模拟实现, 不执行任何程序, 用于测试
+// 容器启动后立即以0退出; Hold为true时保持运行, 直到exit、Kill或Remove
+type fakeRuntime struct {
+	Hold       bool
+	containers map[string]*fakeContainer
+	specs      map[string]containerSpec // 创建过的全部容器, Remove后保留, 用于检查运行使用的镜像
+	images     map[string]bool
+	seq        int
+	lock       sync.Mutex
+}
+
+type fakeContainer struct {
+	spec    containerSpec
+	files   map[string]string // dst -> src
+	started bool
+	done    chan struct{}
+	code    int64
+	oom     bool
+	stdout  string
+	stderr  string
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{containers: make(map[string]*fakeContainer), specs: make(map[string]containerSpec), images: make(map[string]bool)}
+}
+
+func (f *fakeRuntime) Network(ctx context.Context, policy string) (string, error) {
+	if err := networkCheck(policy, false); err != nil {
+		return "", err
+	}
+	if policy == networkNone {
+		return "", nil
+	}
+	return "127.0.0.1", nil
+}
+
+func (f *fakeRuntime) Create(ctx context.Context, spec containerSpec) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.seq++
+	id := fmt.Sprintf("fake%d", f.seq)
+	f.containers[id] = &fakeContainer{spec: spec, files: make(map[string]string), done: make(chan struct{})}
+	f.specs[id] = spec
+	return id, nil
+}
+
+// spec 容器创建时的参数, 容器已删除时同样返回
+func (f *fakeRuntime) spec(id string) (containerSpec, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	spec, ok := f.specs[id]
+	return spec, ok
+}
+
+func (f *fakeRuntime) get(id string) (*fakeContainer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, errNoID
+	}
+	return c, nil
+}
+
+func (f *fakeRuntime) CopyIn(ctx context.Context, id, dst, src string) error {
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	c.files[dst] = src
+	f.lock.Unlock()
+	return nil
+}
+
+// CopyOut 在dst中创建与src同名的空文件
+func (f *fakeRuntime) CopyOut(ctx context.Context, id, src, dst string) error {
+	if _, err := f.get(id); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dst, filepath.Base(src)), nil, 0755)
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, id string) error {
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	c.started = true
+	f.lock.Unlock()
+	if !f.Hold {
+		return f.exit(id, 0, "", "", false)
+	}
+	return nil
+}
+
+// exit 模拟容器退出, 多次调用时仅第一次有效
+func (f *fakeRuntime) exit(id string, code int64, stdout, stderr string, oom bool) error {
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	c.code, c.stdout, c.stderr, c.oom = code, stdout, stderr, oom
+	close(c.done)
+	return nil
+}
+
+func (f *fakeRuntime) Wait(ctx context.Context, id string) (int64, error) {
+	c, err := f.get(id)
+	if err != nil {
+		return -1, err
+	}
+	select {
+	case <-c.done:
+		return c.code, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+// Logs 退出后一次性写入exit指定的输出
+func (f *fakeRuntime) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err = io.WriteString(stdout, c.stdout); err != nil {
+		return err
+	}
+	_, err = io.WriteString(stderr, c.stderr)
+	return err
+}
+
+func (f *fakeRuntime) Kill(ctx context.Context, id string, grace time.Duration) error {
+	return f.exit(id, 143, "", "", false) // SIGTERM
+}
+
+func (f *fakeRuntime) Remove(ctx context.Context, id string) error {
+	if err := f.exit(id, 137, "", "", false); err != nil { // SIGKILL
+		return err
+	}
+	f.lock.Lock()
+	delete(f.containers, id)
+	f.lock.Unlock()
+	return nil
+}
+
+func (f *fakeRuntime) Commit(ctx context.Context, id, ref string) error {
+	if _, err := f.get(id); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.images[ref] = true
+	f.lock.Unlock()
+	return nil
+}
+
+func (f *fakeRuntime) ImageExists(ctx context.Context, ref string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.images[ref]
+}
+
+func (f *fakeRuntime) ImageRemove(ctx context.Context, ref string) error {
+	f.lock.Lock()
+	delete(f.images, ref)
+	f.lock.Unlock()
+	return nil
+}
+
+func (f *fakeRuntime) Stats(ctx context.Context, id string) (containerStats, error) {
+	c, err := f.get(id)
+	if err != nil {
+		return containerStats{}, err
+	}
+	s := containerStats{OOMKilled: c.oom}
+	select {
+	case <-c.done:
+	default:
+		s.Running = c.started
+	}
+	return s, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// 隔离网络(aaf-isolated)的防火墙: internal网络已禁止转发到外部, 但容器仍可访问宿主机上的所有端口
+// 来自该网段的入站连接在INPUT中跳转到链AAF-ISOLATED, 仅放行框架的:2076端口及数据源转发的端口范围
+// (run.proxyPortMin - run.proxyPortMax), 其余丢弃; 每次创建或检查隔离网络时重写该链
+const firewallChain = "AAF-ISOLATED"
+
+// firewallEnsure 为网段subnet安装规则, 需要root权限及iptables
+func firewallEnsure(subnet *net.IPNet) error {
+	rules := [][]string{
+		{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"-p", "tcp", "--dport", "2076", "-j", "ACCEPT"},
+		{"-p", "tcp", "--dport", fmt.Sprintf("%d:%d", conf.Run.ProxyPortMin, conf.Run.ProxyPortMax), "-j", "ACCEPT"},
+		{"-j", "DROP"},
+	}
+	iptables("-N", firewallChain) // 已存在时失败, 忽略
+	if err := iptables("-F", firewallChain); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := iptables(append([]string{"-A", firewallChain}, r...)...); err != nil {
+			return err
+		}
+	}
+	jump := []string{"INPUT", "-s", subnet.String(), "-j", firewallChain}
+	if iptables(append([]string{"-C"}, jump...)...) == nil {
+		return nil
+	}
+	return iptables(append([]string{"-I"}, jump...)...)
+}
+
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// frame format (big endian):
+// version(1 byte) + opcode(1 byte) + requestID(4 bytes) + length(4 bytes) + payload(length bytes)
+// the payload of a request frame is exactly what the legacy protocol sends for a command:
+// "cmd" + ":" + data + "\x00" + the rest of the command stream (argv, file content ...)
+const (
+	frameVersion    byte = 1
+	frameHeaderSize      = 10
+	frameMaxLength       = 256 << 20
+	frameHeadMax         = 64 << 10 // event中结果数据之前的部分(seq及消息头)的上限, 结果上限见conf.Result.MaxSize
+)
+
+// opcode
+const (
+	opRequest  byte = iota + 1 // backend -> framework
+	opResponse                 // framework -> backend, echo the requestID
+	opEvent                    // framework -> backend, pushed by the listener
+)
+
+var (
+	errSwitchFrame    = errors.New("Switch to frame mode")
+	errFrameVersion   = errors.New("Frame version not support")
+	errFrameTooLarge  = errors.New("Frame too large")
+	errFrameOpcode    = errors.New("Unknown frame opcode")
+	errFrameConnClose = errors.New("Frame stream closed")
+)
+
+type frameHeader struct {
+	version   byte
+	opcode    byte
+	requestID uint32
+	length    uint32
+}
+
+// frameWriter 保证同一连接上的frame写入互斥
+type frameWriter struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+// frameConn 在frame模式下提供给handler的连接
+// Read 读取请求frame中剩余的数据, Write 在handler返回前写入response缓存,
+// 之后(如listen)的写入将作为event frame直接发送
+type frameConn struct {
+	net.Conn
+	w         *frameWriter
+	requestID uint32
+	r         *bytes.Reader
+	buf       bytes.Buffer
+	pending   []frameEvent
+	streaming bool
+	closed    bool
+	lock      sync.Mutex
+}
+
+// frameOrigin 记录发起命令的连接及请求ID, 用于结果回显
+type frameOrigin struct {
+	w         *frameWriter
+	requestID uint32
+}
+
+type frameEvent struct {
+	requestID uint32
+	head      []byte
+	body      io.ReadCloser
+	size      int64
+}
+
+// frameNegotiate
+// cmd format: "frame" + ":" + version
+// return: statusOK, switch to frame mode after this response; statusErr, version not support
+func frameNegotiate(conn net.Conn, data []byte) error {
+	v, err := strconv.Atoi(string(data))
+	if err != nil || v != int(frameVersion) {
+		conn.Write(statusErr)
+		return errFrameVersion
+	}
+	conn.Write(statusOK)
+	return errSwitchFrame
+}
+
+// frameServe 每个请求在独立的goroutine中处理, 耗时的命令不会阻塞同一连接上的其他命令
+func frameServe(conn net.Conn, r *bufio.Reader, sess sessionID, mapping map[string]tcpHandlerFunc) {
+	w := &frameWriter{conn: conn}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		h, payload, err := frameRead(r)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		if h.opcode != opRequest {
+			logger.Printf("Session: %s, %v: %d.\n", sess, errFrameOpcode, h.opcode)
+			continue
+		}
+		msg := payload
+		var rest []byte
+		if i := bytes.IndexByte(payload, 0); i >= 0 {
+			msg, rest = payload[:i], payload[i+1:]
+		}
+		cmd, data := dataSplit(msg)
+		fc := &frameConn{
+			Conn:      conn,
+			w:         w,
+			requestID: h.requestID,
+			r:         bytes.NewReader(rest),
+		}
+		f, ok := mapping[cmd]
+		if !ok {
+			logger.Printf("Session: %s, unknow cmd: %s.\n", sess, cmd)
+			fc.Write(statusErr)
+			fc.flush()
+			continue
+		}
+		logger.Printf("session: %s, request: %d, cmd: %s.\n", sess, h.requestID, cmd)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := f(fc, data)
+			if err := fc.flush(); err != nil {
+				logger.Println(err)
+				conn.Close()
+				return
+			}
+			switch err {
+			case errCloseConnect:
+				conn.Close()
+			case nil:
+				break
+			default:
+				logger.Printf("session: %s, request: %d, %v.\n", sess, fc.requestID, err)
+			}
+		}()
+	}
+}
+
+func frameRead(r io.Reader) (h frameHeader, payload []byte, err error) {
+	buf := make([]byte, frameHeaderSize)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	h.version = buf[0]
+	h.opcode = buf[1]
+	h.requestID = binary.BigEndian.Uint32(buf[2:6])
+	h.length = binary.BigEndian.Uint32(buf[6:10])
+	if h.version != frameVersion {
+		err = errFrameVersion
+		return
+	}
+	if h.length > frameMaxLength {
+		err = errFrameTooLarge
+		return
+	}
+	payload = make([]byte, h.length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+func (w *frameWriter) write(opcode byte, requestID uint32, payload []byte) error {
+	return w.writeFrom(opcode, requestID, payload, nil, 0)
+}
+
+// writeFrom 发送负载为head + body(size bytes)的frame, 负载超出frameMaxLength时不发送并返回errFrameTooLarge
+func (w *frameWriter) writeFrom(opcode byte, requestID uint32, head []byte, body io.Reader, size int64) error {
+	length := int64(len(head)) + size
+	if size < 0 || length > frameMaxLength {
+		return errFrameTooLarge
+	}
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(head))
+	buf[0] = frameVersion
+	buf[1] = opcode
+	binary.BigEndian.PutUint32(buf[2:6], requestID)
+	binary.BigEndian.PutUint32(buf[6:10], uint32(length))
+	buf = append(buf, head...)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := w.conn.Write(buf)
+	if err == nil && size > 0 {
+		_, err = io.CopyN(w.conn, body, size)
+	}
+	return err
+}
+
+func (c *frameConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *frameConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, errFrameConnClose
+	}
+	if !c.streaming {
+		return c.buf.Write(b)
+	}
+	if err := c.w.write(opEvent, c.requestID, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// event 发送一个event frame, 发送后关闭body, 在response发送前产生的event将在response之后发送
+func (c *frameConn) event(requestID uint32, head []byte, body io.ReadCloser, size int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		body.Close()
+		return errFrameConnClose
+	}
+	if !c.streaming {
+		c.pending = append(c.pending, frameEvent{requestID: requestID, head: head, body: body, size: size})
+		return nil
+	}
+	defer body.Close()
+	return c.w.writeFrom(opEvent, requestID, head, body, size)
+}
+
+// Close 仅关闭该请求的event流, 不关闭底层连接
+func (c *frameConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	return nil
+}
+
+// flush 发送response frame, 之后的写入作为event发送
+func (c *frameConn) flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.streaming = true
+	err := c.w.write(opResponse, c.requestID, c.buf.Bytes())
+	c.buf.Reset()
+	for _, e := range c.pending {
+		if err == nil {
+			err = c.w.writeFrom(opEvent, e.requestID, e.head, e.body, e.size)
+		}
+		e.body.Close()
+	}
+	c.pending = nil
+	return err
+}
+
+// connOrigin 获取命令的来源, 非frame模式的连接返回空值
+func connOrigin(conn net.Conn) frameOrigin {
+	if fc, ok := conn.(*frameConn); ok {
+		return frameOrigin{w: fc.w, requestID: fc.requestID}
+	}
+	return frameOrigin{}
+}
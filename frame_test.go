@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 负载超出frameMaxLength时不写入任何数据, 连接仍可继续使用
+func TestFrameWriteTooLarge(t *testing.T) {
+	testSetup(t)
+	server, client := testConnPair(t)
+	w := &frameWriter{conn: server}
+	head := []byte("data:R\x00")
+	if err := w.writeFrom(opEvent, 1, head, strings.NewReader(""), frameMaxLength); err != errFrameTooLarge {
+		t.Fatalf("writeFrom: %v, want %v", err, errFrameTooLarge)
+	}
+	if err := w.writeFrom(opEvent, 1, head, strings.NewReader(""), 1<<32); err != errFrameTooLarge { // uint32溢出
+		t.Fatalf("writeFrom: %v, want %v", err, errFrameTooLarge)
+	}
+	if err := w.write(opEvent, 2, []byte("ok\x00")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	h, payload, err := frameRead(client)
+	if err != nil || h.requestID != 2 || string(payload) != "ok\x00" {
+		t.Fatalf("frame %+v %q, %v", h, payload, err)
+	}
+}
+
+// result.maxSize不能超出一个event frame能承载的结果大小
+func TestConfResultMaxSize(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	path := t.TempDir() + "/config.json"
+	ioutil.WriteFile(path, []byte(`{"result": {"maxSize": 1073741824}}`), 0644)
+	if err := confRead(path); err == nil {
+		t.Fatal("result.maxSize above the frame limit accepted")
+	}
+	conf = saved
+	ioutil.WriteFile(path, []byte(`{}`), 0644)
+	if err := confRead(path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// resourceLimits 容器资源限制, 0(空)表示不限制
+// 优先级: start命令(运行) > 上传时指定(程序) > config.json
+type resourceLimits struct {
+	Memory    int64    `json:"memory,omitempty"`    // 内存上限(bytes), swap不额外分配
+	CPUs      float64  `json:"cpus,omitempty"`      // 可使用的CPU数, 如0.5
+	CPUShares int64    `json:"cpuShares,omitempty"` // CPU相对权重
+	Pids      int64    `json:"pids,omitempty"`      // 最大进程(线程)数
+	Tmpfs     int64    `json:"tmpfs,omitempty"`     // 挂载于/tmp的tmpfs大小(bytes)
+	Disk      int64    `json:"disk,omitempty"`      // 容器可写层大小(bytes), 需存储驱动支持
+	Ulimits   []string `json:"ulimits,omitempty"`   // 如"nofile=1024:2048"
+}
+
+var errLimitErr = errors.New("Resource limit error")
+
+// limitsParse 解析选项中的资源限制
+// memory, tmpfs, disk: 512m, 1g ...; cpus: 0.5; cpuShares, pids: 整数; ulimit: nofile=1024:2048(可重复)
+func limitsParse(opt url.Values) (l resourceLimits, err error) {
+	size := func(key string) int64 {
+		v := opt.Get(key)
+		if v == "" || err != nil {
+			return 0
+		}
+		var n int64
+		if n, err = units.RAMInBytes(v); err == nil && n < 0 {
+			err = errLimitErr
+		}
+		return n
+	}
+	integer := func(key string) int64 {
+		v := opt.Get(key)
+		if v == "" || err != nil {
+			return 0
+		}
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 64); err == nil && n < 0 {
+			err = errLimitErr
+		}
+		return n
+	}
+	l.Memory = size("memory")
+	l.Tmpfs = size("tmpfs")
+	l.Disk = size("disk")
+	l.CPUShares = integer("cpuShares")
+	l.Pids = integer("pids")
+	if v := opt.Get("cpus"); v != "" && err == nil {
+		l.CPUs, err = strconv.ParseFloat(v, 64)
+	}
+	l.Ulimits = opt["ulimit"]
+	if err != nil {
+		return l, err
+	}
+	return l, l.check()
+}
+
+func (l resourceLimits) check() error {
+	if l.Memory < 0 || !(l.CPUs >= 0) || math.IsInf(l.CPUs, 1) || l.CPUShares < 0 || l.Pids < 0 || l.Tmpfs < 0 || l.Disk < 0 { // cpus可解析为NaN, Inf
+		return errLimitErr
+	}
+	for _, v := range l.Ulimits {
+		if _, err := units.ParseUlimit(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge 以o中非空的项覆盖l
+func (l resourceLimits) merge(o resourceLimits) resourceLimits {
+	if o.Memory != 0 {
+		l.Memory = o.Memory
+	}
+	if o.CPUs != 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.CPUShares != 0 {
+		l.CPUShares = o.CPUShares
+	}
+	if o.Pids != 0 {
+		l.Pids = o.Pids
+	}
+	if o.Tmpfs != 0 {
+		l.Tmpfs = o.Tmpfs
+	}
+	if o.Disk != 0 {
+		l.Disk = o.Disk
+	}
+	if len(o.Ulimits) != 0 { // 按名称覆盖
+		ulimits := make([]string, 0, len(l.Ulimits)+len(o.Ulimits))
+		names := make(map[string]bool)
+		for _, v := range o.Ulimits {
+			u, _ := units.ParseUlimit(v)
+			names[u.Name] = true
+		}
+		for _, v := range l.Ulimits {
+			if u, _ := units.ParseUlimit(v); !names[u.Name] {
+				ulimits = append(ulimits, v)
+			}
+		}
+		l.Ulimits = append(ulimits, o.Ulimits...)
+	}
+	return l
+}
+
+// hostConfig 转换为容器的HostConfig
+func (l resourceLimits) hostConfig() (*container.HostConfig, error) {
+	cfg := &container.HostConfig{}
+	cfg.Memory = l.Memory
+	if l.Memory > 0 {
+		cfg.MemorySwap = l.Memory
+	}
+	cfg.NanoCPUs = int64(l.CPUs * 1e9)
+	cfg.CPUShares = l.CPUShares
+	cfg.PidsLimit = l.Pids
+	if l.Tmpfs > 0 {
+		cfg.Tmpfs = map[string]string{"/tmp": fmt.Sprintf("rw,size=%d", l.Tmpfs)}
+	}
+	if l.Disk > 0 {
+		cfg.StorageOpt = map[string]string{"size": strconv.FormatInt(l.Disk, 10)}
+	}
+	for _, v := range l.Ulimits {
+		u, err := units.ParseUlimit(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Ulimits = append(cfg.Ulimits, u)
+	}
+	return cfg, nil
+}
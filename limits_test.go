@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestLimitsParse(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  resourceLimits
+		ok    bool
+	}{
+		{"", resourceLimits{}, true},
+		{"memory=512m&tmpfs=64m&disk=1g", resourceLimits{Memory: 512 << 20, Tmpfs: 64 << 20, Disk: 1 << 30}, true},
+		{"memory=1048576", resourceLimits{Memory: 1 << 20}, true},
+		{"memory=1.5g", resourceLimits{Memory: 3 << 29}, true},
+		{"cpus=0.5&cpuShares=512&pids=100", resourceLimits{CPUs: 0.5, CPUShares: 512, Pids: 100}, true},
+		{"ulimit=nofile=1024:2048&ulimit=nproc=64", resourceLimits{Ulimits: []string{"nofile=1024:2048", "nproc=64"}}, true},
+		{"memory=512x", resourceLimits{}, false},
+		{"memory=-1m", resourceLimits{}, false},
+		{"tmpfs=lots", resourceLimits{}, false},
+		{"disk=1q", resourceLimits{}, false},
+		{"cpus=half", resourceLimits{}, false},
+		{"cpus=-0.5", resourceLimits{}, false},
+		{"cpus=NaN", resourceLimits{}, false},
+		{"cpus=Inf", resourceLimits{}, false},
+		{"pids=-1", resourceLimits{}, false},
+		{"pids=1.5", resourceLimits{}, false},
+		{"cpuShares=1k", resourceLimits{}, false},
+		{"ulimit=nofile", resourceLimits{}, false},
+		{"ulimit=nofile=a:b", resourceLimits{}, false},
+	} {
+		opt, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := limitsParse(opt)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: err %v", c.query, err)
+			continue
+		}
+		if c.ok && !reflect.DeepEqual(l, c.want) {
+			t.Errorf("%q: %+v, want %+v", c.query, l, c.want)
+		}
+	}
+}
+
+// 运行的选项覆盖程序的选项, 程序的选项覆盖config.json, 未指定的项保持不变, ulimit按名称覆盖
+func TestLimitsMerge(t *testing.T) {
+	cfg := resourceLimits{Memory: 1 << 30, CPUs: 2, Pids: 256, Ulimits: []string{"nofile=1024", "nproc=64"}}
+	program := resourceLimits{Memory: 512 << 20, Tmpfs: 64 << 20, Ulimits: []string{"nofile=2048"}}
+	run := resourceLimits{CPUs: 0.5, Ulimits: []string{"nofile=4096", "core=0"}}
+	for _, c := range []struct {
+		name string
+		got  resourceLimits
+		want resourceLimits
+	}{
+		{"conf", cfg.merge(resourceLimits{}), cfg},
+		{"program", cfg.merge(program), resourceLimits{Memory: 512 << 20, CPUs: 2, Pids: 256, Tmpfs: 64 << 20, Ulimits: []string{"nproc=64", "nofile=2048"}}},
+		{"run", cfg.merge(program).merge(run), resourceLimits{Memory: 512 << 20, CPUs: 0.5, Pids: 256, Tmpfs: 64 << 20, Ulimits: []string{"nproc=64", "nofile=4096", "core=0"}}},
+		{"run only", resourceLimits{}.merge(run), run},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: %+v, want %+v", c.name, c.got, c.want)
+		}
+	}
+	// runStart中的合并顺序
+	saved := conf
+	defer func() { conf = saved }()
+	conf.Limits = cfg
+	got := programOptions{Limits: conf.Limits}.merge(programOptions{Limits: program}).merge(programOptions{Limits: run})
+	if want := cfg.merge(program).merge(run); !reflect.DeepEqual(got.Limits, want) {
+		t.Errorf("options: %+v, want %+v", got.Limits, want)
+	}
+}
+
+func TestLimitsHostConfig(t *testing.T) {
+	cfg, err := resourceLimits{Memory: 512 << 20, CPUs: 0.5, Pids: 10, Tmpfs: 1 << 20, Ulimits: []string{"nofile=1024:2048"}}.hostConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Memory != 512<<20 || cfg.MemorySwap != cfg.Memory || cfg.NanoCPUs != 5e8 || cfg.PidsLimit != 10 ||
+		cfg.Tmpfs["/tmp"] != "rw,size=1048576" || len(cfg.Ulimits) != 1 || cfg.Ulimits[0].Hard != 2048 {
+		t.Fatalf("host config %+v", cfg)
+	}
+	if cfg, err = (resourceLimits{}).hostConfig(); err != nil || cfg.MemorySwap != 0 || cfg.Tmpfs != nil {
+		t.Fatalf("no limits: %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// localRuntime 以本地进程运行程序, 每个运行使用dir下独立的工作目录
+// 进程以框架的权限运行, 不提供任何隔离, 需在配置中以runtime.insecure确认(见runtimeOpen)
+// 基础镜像被忽略, Commit将工作目录保存至dir/.images, 以该镜像创建时复制到工作目录
+// 仅支持full网络策略; 资源限制仅支持memory及ulimits(通过sh的ulimit设置), 其余被忽略
+type localRuntime struct {
+	dir   string
+	procs map[string]*localProcess
+	lock  sync.Mutex
+}
+
+type localProcess struct {
+	spec   containerSpec
+	dir    string
+	cmd    *exec.Cmd
+	stdout *os.File // 管道的读端, 由Logs读取
+	stderr *os.File
+	done   chan struct{}
+	code   int64
+}
+
+// ulimit名称对应的sh参数
+var ulimitFlags = map[string]string{
+	"core":    "c",
+	"cpu":     "t",
+	"fsize":   "f",
+	"memlock": "l",
+	"nofile":  "n",
+	"nproc":   "u",
+	"stack":   "s",
+}
+
+func newLocalRuntime(dir string) (*localRuntime, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localRuntime{dir: dir, procs: make(map[string]*localProcess)}, nil
+}
+
+func (l *localRuntime) Network(ctx context.Context, policy string) (string, error) {
+	if policy != networkFull {
+		return "", errNetworkSupport
+	}
+	return "127.0.0.1", nil
+}
+
+func (l *localRuntime) Create(ctx context.Context, spec containerSpec) (string, error) {
+	if spec.Network != networkFull {
+		return "", errNetworkSupport
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	p := &localProcess{spec: spec, dir: l.dir + "/" + id, done: make(chan struct{})}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return "", err
+	}
+	if image := l.imagePath(spec.Image); pathStat(image) == directory {
+		if err := copyTree(image, p.dir); err != nil {
+			os.RemoveAll(p.dir)
+			return "", err
+		}
+	}
+	l.lock.Lock()
+	l.procs[id] = p
+	l.lock.Unlock()
+	return id, nil
+}
+
+func (l *localRuntime) get(id string) (*localProcess, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p, ok := l.procs[id]
+	if !ok {
+		return nil, errNoID
+	}
+	return p, nil
+}
+
+// CopyIn dst为沙箱中的路径, 以spec.WorkingDir为工作目录的根
+func (l *localRuntime) CopyIn(ctx context.Context, id, dst, src string) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(p.spec.WorkingDir, filepath.Join("/", dst))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return errNotSupport
+	}
+	return copyTree(src, filepath.Join(p.dir, rel))
+}
+
+func (l *localRuntime) CopyOut(ctx context.Context, id, src, dst string) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(p.spec.WorkingDir, filepath.Join("/", src))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return errNotSupport
+	}
+	return copyTree(filepath.Join(p.dir, rel), dst)
+}
+
+func (l *localRuntime) Start(ctx context.Context, id string) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	if p.cmd != nil || len(p.spec.Cmd) == 0 {
+		return errNotSupport
+	}
+	script, err := localLimits(p.spec.Limits)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-c", script + `exec "$@"`, "sh"}, p.spec.Cmd...)
+	cmd := exec.Command("/bin/sh", args...)
+	cmd.Dir = p.dir
+	// 不继承框架的环境变量, 仅保留PATH以找到解释器, HOME为工作目录
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH"), "HOME=" + p.dir}, p.spec.Env...)
+	cmd.Env = append(cmd.Env, "PIP_USER=1", "PYTHONUSERBASE="+p.dir+"/.pip") // 依赖安装在工作目录中
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var w [2]*os.File
+	if p.stdout, w[0], err = os.Pipe(); err != nil {
+		return err
+	}
+	if p.stderr, w[1], err = os.Pipe(); err != nil {
+		p.stdout.Close()
+		w[0].Close()
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = w[0], w[1]
+	err = cmd.Start()
+	w[0].Close()
+	w[1].Close()
+	if err != nil {
+		p.stdout.Close()
+		p.stderr.Close()
+		return err
+	}
+	p.cmd = cmd
+	go func() {
+		cmd.Wait()
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			p.code = 128 + int64(ws.Signal()) // 与Docker一致
+		} else {
+			p.code = int64(cmd.ProcessState.ExitCode())
+		}
+		close(p.done)
+	}()
+	return nil
+}
+
+func (l *localRuntime) Wait(ctx context.Context, id string) (int64, error) {
+	p, err := l.get(id)
+	if err != nil {
+		return -1, err
+	}
+	select {
+	case <-p.done:
+		return p.code, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+func (l *localRuntime) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	if p.cmd == nil {
+		return errNotSupport
+	}
+	ch := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stderr, p.stderr)
+		ch <- err
+	}()
+	_, err = io.Copy(stdout, p.stdout)
+	if e := <-ch; err == nil {
+		err = e
+	}
+	return err
+}
+
+// Kill 向进程组发送SIGTERM, grace后SIGKILL
+func (l *localRuntime) Kill(ctx context.Context, id string, grace time.Duration) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	if p.cmd == nil {
+		return nil
+	}
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(grace):
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
+
+func (l *localRuntime) Remove(ctx context.Context, id string) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	if p.cmd != nil {
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		<-p.done
+		p.stdout.Close()
+		p.stderr.Close()
+	}
+	l.lock.Lock()
+	delete(l.procs, id)
+	l.lock.Unlock()
+	return os.RemoveAll(p.dir)
+}
+
+func (l *localRuntime) Stats(ctx context.Context, id string) (containerStats, error) {
+	p, err := l.get(id)
+	if err != nil {
+		return containerStats{}, err
+	}
+	s := containerStats{}
+	if p.cmd != nil {
+		select {
+		case <-p.done: // 退出后取wait4返回的资源使用
+			if ru, ok := p.cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+				s.CPUTime = time.Duration(syscall.TimevalToNsec(ru.Utime) + syscall.TimevalToNsec(ru.Stime))
+				s.MemoryPeak = ru.Maxrss << 10 // KB
+			}
+		default:
+			s.Running = true
+		}
+	}
+	return s, nil
+}
+
+func (l *localRuntime) Commit(ctx context.Context, id, ref string) error {
+	p, err := l.get(id)
+	if err != nil {
+		return err
+	}
+	image := l.imagePath(ref)
+	os.RemoveAll(image)
+	return copyTree(p.dir, image)
+}
+
+func (l *localRuntime) ImageExists(ctx context.Context, ref string) bool {
+	return pathStat(l.imagePath(ref)) == directory
+}
+
+func (l *localRuntime) ImageRemove(ctx context.Context, ref string) error {
+	return os.RemoveAll(l.imagePath(ref))
+}
+
+func (l *localRuntime) imagePath(ref string) string {
+	return l.dir + "/.images/" + strings.NewReplacer("/", "_", ":", "_").Replace(ref)
+}
+
+// localLimits 生成设置资源限制的sh命令
+func localLimits(l resourceLimits) (string, error) {
+	script := ""
+	if l.Memory > 0 {
+		script += fmt.Sprintf("ulimit -v %d && ", l.Memory>>10)
+	}
+	for _, v := range l.Ulimits {
+		u, err := units.ParseUlimit(v)
+		if err != nil {
+			return "", err
+		}
+		flag, ok := ulimitFlags[u.Name]
+		if !ok {
+			continue
+		}
+		script += fmt.Sprintf("ulimit -S -%s %d && ulimit -H -%s %d && ", flag, u.Soft, flag, u.Hard)
+	}
+	return script, nil
+}
+
+// copyTree 复制文件或目录
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if rel == "." { // src为文件
+			target = filepath.Join(dst, fi.Name())
+			if err = os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		return err
+	})
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -12,62 +11,83 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 )
 
 type fileType int
 type programIndex string
 type programInfo struct {
-	dir       string
+	id        programIndex
+	revision  int
+	dir       string // 版本目录
 	file      fileType
 	immediate bool
-	ctx       context.Context
-	cancel    context.CancelFunc
+	options   programOptions
+	// 以下仅用于描述程序, 见programManifest
+	description string
+	owner       string
+	created     time.Time
+	sourceHash  string
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 type processInfo struct {
 	cancel    context.CancelFunc
 	immediate bool
+	program   programIndex
+	container string // 容器运行时的ID
+	origin    frameOrigin
 }
 
 const (
 	python2 fileType = iota
 	python3
 	golang
+	nodejs
+	java
+	cpp // C/C++
 )
 
 var (
-	bufferSlice          = 2048
-	ctxRoot              context.Context
-	ctxRootCancel        context.CancelFunc
-	errAuthFailed        = errors.New("Auth failed, key error")
-	errTypeErr           = errors.New("Unknown type")
-	errEOF               = errors.New("Error EOF")
-	errNoID              = errors.New("ID not existed")
-	errTransferErr       = errors.New("Transfer err, got wrong data")
-	errNoMapping         = errors.New("No value with this key")
-	mqLock               = sync.Mutex{}
-	logger               *MultiLogger
-	key                  string
-	statusOK             = []byte("ok\x00")
-	statusErr            = []byte("error\x00")
-	statusTypeErr        = []byte("typeErr\x00")
-	storePath            = "program"
-	programMapping       = make(map[programIndex]programInfo)
-	pwd                  string
-	tcpForDocker         = make(map[string]tcpHandlerFunc)
-	addressToContainerID = make(map[string]string)
-	dbListMapping        = make(map[string][]dbInfo)
-	processMapping       = make(map[string]processInfo)
-	containerSessToID    = make(map[sessionID]string)
+	ctxRoot           context.Context
+	ctxRootCancel     context.CancelFunc
+	errAuthFailed     = errors.New("Auth failed, key error")
+	errTypeErr        = errors.New("Unknown type")
+	errEOF            = errors.New("Error EOF")
+	errNoID           = errors.New("ID not existed")
+	errTransferErr    = errors.New("Transfer err, got wrong data")
+	errNoMapping      = errors.New("No value with this key")
+	errTimeoutErr     = errors.New("Timeout must not be negative")
+	mqLock            = sync.Mutex{}
+	programLock       = sync.RWMutex{}
+	processLock       = sync.RWMutex{} // processMapping, containerSessToID, dbListMapping, proxyMapping, addressToRunID
+	logger            *MultiLogger
+	key               string
+	statusOK          = []byte("ok\x00")
+	statusErr         = []byte("error\x00")
+	statusTypeErr     = []byte("typeErr\x00")
+	storePath         = "program"
+	programMapping    = make(map[programIndex]*programEntry)
+	pwd               string
+	tcpForDocker      = make(map[string]tcpHandlerFunc)
+	addressToRunID    = make(map[string]string)
+	dbListMapping     = make(map[string][]dbInfo)
+	proxyMapping      = make(map[string][]net.Listener) // datasource网络策略下的数据源转发
+	processMapping    = make(map[string]processInfo)
+	containerSessToID = make(map[sessionID]string)
 )
 
-func init() {
+// setup 读取密钥、配置及持久化的状态, 在main中调用(测试不需要login.key及容器运行时)
+func setup() {
 	f, err := os.Open("login.key")
 	if err != nil {
 		os.Exit(-1)
@@ -76,11 +96,29 @@ func init() {
 	f.Close()
 	ctxRoot, ctxRootCancel = context.WithCancel(context.Background())
 	logger = NewMultiLogger(30*24*time.Hour, "log")
+	if err = confRead(configPath); err != nil {
+		logger.Fatal(err)
+	}
+	if rt, err = runtimeOpen(conf.Runtime); err != nil {
+		logger.Fatal(err)
+	}
 	IDReader(programMapping)
+	go imageMaintain() // 构建缺失或依赖已变化的程序镜像
+	if err = historyOpen(storePath + "/.runs"); err != nil {
+		logger.Fatal(err)
+	}
+	logSweep()
+	spillSweep()
+	go historyMaintain()
+	if err = mqOpen(storePath + "/.queue"); err != nil {
+		logger.Fatal(err)
+	}
+	go mqPush() // start push service
 	pwd = filepath.Dir(os.Args[0]) + "/"
 }
 
 func main() {
+	setup()
 	logger.Println("Starting...")
 	cert, err := tls.LoadX509KeyPair("CA/xx.hhuiot.xyz.pem", "CA/xx.hhuiot.xyz.key")
 	if err != nil {
@@ -94,10 +132,19 @@ func main() {
 	signalHandleRegister(os.Kill, ctxRootCancel, nil)
 	signalListenAndServe(ctxRoot, nil)
 	tcpConnectHandleRegister("auth", authIn, nil)
+	tcpConnectHandleRegister("frame", frameNegotiate, nil)
 	tcpConnectHandleRegister("fileTransfer", fileReceiver, nil)
 	tcpConnectHandleRegister("removeFile", fileRemover, nil)
 	tcpConnectHandleRegister("getFile", getFile, nil)
+	tcpConnectHandleRegister("listPrograms", listPrograms, nil)
+	tcpConnectHandleRegister("listRevisions", listRevisions, nil)
+	tcpConnectHandleRegister("promote", revisionPromote, nil)
+	tcpConnectHandleRegister("rollback", revisionRollback, nil)
+	tcpConnectHandleRegister("getLog", getLog, nil)
+	tcpConnectHandleRegister("listRuns", listRuns, nil)
+	tcpConnectHandleRegister("getRun", getRun, nil)
 	tcpConnectHandleRegister("listen", statusListenRegister, nil)
+	tcpConnectHandleRegister("ack", statusAck, nil)
 	tcpConnectHandleRegister("start", execStart, nil)
 	tcpConnectHandleRegister("stop", execStop, nil)
 	tcpConnectHandleRegister("disconnect", disconnectForListener, nil)
@@ -105,10 +152,14 @@ func main() {
 	tcpConnectHandleRegister("disconnect", disconnectForDocker, tcpForDocker)
 	tcpConnectHandleRegister("dbList", dbInfoGet, tcpForDocker)
 	tcpConnectHandleRegister("send", dataSend, tcpForDocker)
+	tcpConnectHandleRegister("progress", progressSend, tcpForDocker)
+	tcpConnectHandleRegister("log", logSend, tcpForDocker)
 	tcpListenAndServe(ctxRoot, ":443", config, nil) // exposed port
 	tcpListenAndServe(ctxRoot, ":2076", nil, tcpForDocker)
+	restListenAndServe(ctxRoot, ":8443", config)
 	stdinHandleRegister("exit", exit, nil)
 	stdinHandleRegister("listSession", listSession, nil)
+	stdinHandleRegister("listPrograms", listProgramsConsole, nil)
 	stdinListenerAndServe(ctxRoot, nil)
 	select {}
 }
@@ -119,12 +170,47 @@ func exit(param ...string) {
 
 func listSession(param ...string) {
 	fmt.Print("Session\t\tRemoteAddr\n")
+	sessionLock.RLock()
 	for k, v := range sessionMapping {
-		fmt.Printf("%s\t\t%s", k, v.RemoteAddr().String())
+		fmt.Printf("%s\t\t%s\n", k, v.RemoteAddr().String())
+	}
+	sessionLock.RUnlock()
+}
+
+// listProgramsConsole listPrograms [language=python3&offset=0&limit=100]
+func listProgramsConsole(param ...string) {
+	opt := url.Values{}
+	if len(param) > 0 {
+		var err error
+		if opt, err = url.ParseQuery(param[0]); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	q, err := catalogParse(opt)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	page := programList(q)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprint(w, "ID\tLanguage\tImmediate\tRevision\tSize\tCreated\tLastRun\tRuns\n")
+	for _, v := range page.Programs {
+		lastRun := "-"
+		if v.LastRun != nil {
+			lastRun = v.LastRun.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%d\t%s\t%s\t%d\n", v.ID, v.Language, v.Immediate, v.Revision, v.Size,
+			v.Created.Format("2006-01-02 15:04:05"), lastRun, v.Runs)
 	}
+	w.Flush()
+	fmt.Printf("%d-%d of %d\n", page.Offset+1, page.Offset+len(page.Programs), page.Total)
 }
 
 func authIn(conn net.Conn, data []byte) error {
+	if networkIsolated(conn.RemoteAddr().String()) { // 隔离网络中的容器仅能访问:2076
+		return errAuthFailed
+	}
 	r := bufio.NewReader(conn)
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	data, _ = readBytes(0, r)
@@ -141,8 +227,13 @@ func authIn(conn net.Conn, data []byte) error {
 func authForDocker(conn net.Conn, data []byte) error {
 	r := bufio.NewReader(conn)
 	sess, _ := readString(0, r)
-	if v, ok := containerSessToID[sessionID(sess)]; ok {
-		addressToContainerID[conn.RemoteAddr().String()] = v
+	processLock.Lock()
+	v, ok := containerSessToID[sessionID(sess)]
+	if ok {
+		addressToRunID[conn.RemoteAddr().String()] = v
+	}
+	processLock.Unlock()
+	if ok {
 		conn.Write(statusOK)
 		return nil
 	}
@@ -151,7 +242,9 @@ func authForDocker(conn net.Conn, data []byte) error {
 }
 
 func disconnectForDocker(conn net.Conn, data []byte) error {
-	delete(addressToContainerID, conn.RemoteAddr().String())
+	processLock.Lock()
+	delete(addressToRunID, conn.RemoteAddr().String())
+	processLock.Unlock()
 	return nil
 }
 
@@ -165,35 +258,105 @@ func disconnectForListener(conn net.Conn, data []byte) error {
 	return nil
 }
 
+// statusListenRegister
+// cmd format: "listen" + ":" + options("&"分隔)
+// options: "ack", 每条消息前附加 "seq:" + seq + "\x00", 需使用ack命令确认, 否则发送成功即视为确认
+// "window=" + bytes, ack模式下允许未确认消息的最大字节数, 未设置时每条消息均需等待ack
+// "from=" + seq, 从指定序号开始推送; "since=" + RFC3339时间或unix时间戳, 从该时间之后的消息开始推送
+// 默认从第一条未确认的消息开始推送
 func statusListenRegister(conn net.Conn, data []byte) error {
+	opt, err := url.ParseQuery(string(data))
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	_, ack := opt["ack"]
+	var window int64
+	if v := opt.Get("window"); v != "" {
+		if window, err = strconv.ParseInt(v, 10, 64); err != nil {
+			conn.Write(statusErr)
+			return err
+		}
+	}
+	var from uint64
+	var since time.Time
+	if v := opt.Get("from"); v != "" {
+		if from, err = strconv.ParseUint(v, 10, 64); err != nil {
+			conn.Write(statusErr)
+			return err
+		}
+	}
+	if v := opt.Get("since"); v != "" {
+		if since, err = timeParse(v); err != nil {
+			conn.Write(statusErr)
+			return err
+		}
+	}
+	mqMutex.Lock()
 	listenerLock.Lock()
 	if connListener != nil {
 		connListener.Close()
 		runtime.SetFinalizer(connListener, nil)
 	}
 	connListener = conn
-	if pushServiceLocked {
-		pushLock <- struct{}{}
+	listenerAck = ack
+	listenerWindow = window
+	listenerGen++
+	mqSent = 0
+	switch {
+	case from != 0:
+		mqNext = from
+	case !since.IsZero():
+		mqNext = mqSeek(since)
+	default:
+		mqNext = mqAcked + 1
 	}
+	mqNotify()
 	listenerLock.Unlock()
+	mqMutex.Unlock()
 	runtime.SetFinalizer(connListener, (net.Conn).Close)
 	conn.Write(statusOK)
 	logger.Printf("New Listener: %s.\n", conn.RemoteAddr().String())
 	return nil
 }
 
-func statusSend(conn net.Conn, data []byte) {
-	if connListener != nil {
-		length := len(data)
-		i := bufferSlice
-		for ; i <= length; i += bufferSlice {
-			connListener.Write(data[i-bufferSlice : i])
-			time.Sleep(40 * time.Millisecond)
-		}
-		if length%bufferSlice != 0 {
-			connListener.Write(data[i-bufferSlice:])
+// statusSend frame模式下每条消息作为一个event发送,
+// 若该运行由同一连接上的start命令发起, 则回显start的请求ID, 发送后关闭msg.body
+func statusSend(conn net.Conn, msg *mqMessage) error {
+	if fc, ok := conn.(*frameConn); ok {
+		requestID := fc.requestID
+		if msg.origin.w == fc.w {
+			requestID = msg.origin.requestID
 		}
+		return fc.event(requestID, msg.head, msg.body, msg.size)
+	}
+	defer msg.body.Close()
+	// 由TCP提供背压
+	if _, err := conn.Write(msg.head); err != nil {
+		return err
+	}
+	_, err := io.CopyN(conn, msg.body, msg.size)
+	return err
+}
+
+// timeParse 解析RFC3339时间或unix时间戳
+// 选项经过URL解码, 时区中未编码的"+"(如+08:00)被解码为空格, RFC3339中不含空格, 此处还原
+func timeParse(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
 	}
+	return time.Parse(time.RFC3339, strings.Replace(s, " ", "+", 1))
+}
+
+// statusAck
+// cmd format: "ack" + ":" + seq, 确认seq及之前的所有消息
+// 为避免与推送的消息混淆, 不返回状态
+func statusAck(conn net.Conn, data []byte) error {
+	seq, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	return mqAck(seq)
 }
 
 func execStart(conn net.Conn, data []byte) error {
@@ -201,12 +364,28 @@ func execStart(conn net.Conn, data []byte) error {
 		conn.Write(statusErr)
 		return errTypeErr
 	}
-	id := programIndex(data) // programID
-	var p programInfo
-	var ok bool
-	if p, ok = programMapping[id]; !ok {
+	programID, opt, err := optionSplit(data)
+	if err != nil {
 		conn.Write(statusErr)
-		return errNoID
+		return err
+	}
+	id := programIndex(programID)
+	if _, err := programGet(id); err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	options, err := optionsParse(opt)
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	rev, err := revisionParse(opt.Get("revision"))
+	if err == nil {
+		_, err = revisionGet(id, rev)
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
 	}
 	conn.Write(statusOK) // response
 	// Get Argv
@@ -222,7 +401,10 @@ func execStart(conn net.Conn, data []byte) error {
 	// number of database(1 byte) +
 	// db Type; db Address; db database; db userName; db password + "\x00" ....(repeat)
 	num := make([]byte, 1)
-	conn.Read(num)
+	if _, err = io.ReadFull(r, num); err != nil {
+		conn.Write(statusErr)
+		return err
+	}
 	dbList := make([]dbInfo, int(num[0]))
 	flag := false
 	for i := byte(0); i < num[0]; i++ {
@@ -242,117 +424,167 @@ func execStart(conn net.Conn, data []byte) error {
 		conn.Write(statusErr)
 		return errTransferErr
 	}
-	containerID, err := newProcess(p.ctx, p, argv, dbList)
+	runID, err := runStart(id, rev, argv, dbList, options, connOrigin(conn))
 	if err != nil {
 		conn.Write(statusErr)
 		return err
 	}
-	conn.Write(statusOK) // response + containerID + "\x00"
-	conn.Write([]byte(containerID + "\x00"))
+	conn.Write(statusOK) // response + runID + "\x00"
+	conn.Write([]byte(runID + "\x00"))
 	return err
 }
 
 func execStop(conn net.Conn, data []byte) error {
-	containerID := string(data)
-	if v, ok := processMapping[containerID]; ok {
-		v.cancel()
-		delete(processMapping, containerID)
-		conn.Write(statusOK)
-		return nil
+	if err := runStop(string(data)); err != nil {
+		conn.Write(statusErr)
+		return err
 	}
-	conn.Write(statusErr)
-	return errNoID
+	conn.Write(statusOK)
+	return nil
 }
 
 // fileReceiver
 // cmd format: "fileTransfer" + ":" + type(lower bit: filetype, higher bit result type) + "\x00" + fileSize(bytes) + "\x00"
+// options: "program=" + ID, 为已有程序上传新版本(ID不变), "promote=false"时不设为当前版本
+// "hash=true"时在programID之后返回保存的源文件(或归档)的sha256 + "\x00"
 // conn return: status
 // if got statusOK, then transfer the file, if got No statusMsg, it means programID to the file
 func fileReceiver(conn net.Conn, data []byte) error {
-	id := fmt.Sprint(time.Now().Unix())
-	path := fmt.Sprintf("%s/%s", storePath, id)
-	err := os.MkdirAll(path, 0755)
+	if len(data) < 1 {
+		conn.Write(statusTypeErr)
+		return errTypeErr
+	}
+	s, err := programTypeParse(data[0])
 	if err != nil {
-		conn.Write(statusErr)
+		conn.Write(statusTypeErr)
 		return err
 	}
-	fileName := "main."
-	s := programInfo{}
-	s.dir = path
-	switch data[0] & 0x7F {
-	case 1:
-		s.file = python2
-		fileName += "py"
-	case 2:
-		s.file = python3
-		fileName += "py"
-		f, _ := os.Open("source/driver.py")
-		w, _ := os.OpenFile(path+"/driver.py", os.O_CREATE|os.O_WRONLY, 0644)
-		io.Copy(w, f)
-		f.Close()
-		w.Close()
-	case 3:
-		s.file = golang
-		fileName += "go"
-	default:
-		conn.Write(statusTypeErr)
-		return errTypeErr
+	_, opt, err := optionSplit(data[1:])
+	if err == nil {
+		err = uploadParse(&s, opt)
 	}
-	if (data[0] & 0x80) == 0x80 {
-		s.immediate = true
-	} else {
-		s.immediate = false
+	var promote, hash bool
+	if err == nil {
+		promote, err = promoteParse(opt.Get("promote"))
+	}
+	if err == nil && opt.Get("hash") != "" {
+		hash, err = strconv.ParseBool(opt.Get("hash"))
 	}
-	file, err := os.OpenFile(path+"/"+fileName, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		conn.Write(statusErr)
 		return err
 	}
 	conn.Write(statusOK)
 	data = make([]byte, 4)
-	conn.Read(data)
-	length := binary.BigEndian.Uint32(data[:4])
-	if _, err = io.CopyN(file, conn, int64(length)); err != nil {
-		file.Close()
-		os.RemoveAll(path)
+	if _, err = io.ReadFull(conn, data); err != nil {
 		conn.Write(statusErr)
 		return err
 	}
-	file.Close()
-	if err = builder(s); err != nil {
-		os.RemoveAll(path)
+	length := binary.BigEndian.Uint32(data[:4])
+	if id := programIndex(opt.Get("program")); id == "" {
+		s, err = programCreate(s, conn, int64(length))
+	} else {
+		s, err = revisionCreate(id, s, conn, int64(length), promote)
+	}
+	if err != nil {
 		conn.Write(statusErr)
 		return err
 	}
 	conn.Write(statusOK)
-	conn.Write([]byte(id + "\x00"))
-	s.ctx, s.cancel = context.WithCancel(ctxRoot)
-	programMapping[programIndex(id)] = s
-	s.cfgStore()
-	return err
+	conn.Write([]byte(s.id + "\x00"))
+	if hash {
+		conn.Write([]byte(s.sourceHash + "\x00"))
+	}
+	return nil
 }
 
+// getFile 获取程序的源文件或上传的归档
+// cmd format: "getFile" + ":" + ID + ["?path=" + 相对路径 | "?archive=true"] + ["&revision=" + 版本号], 未指定时为当前版本的入口文件
+// return: statusErr; length(4 bytes) + data
 func getFile(conn net.Conn, data []byte) error {
-	id := programIndex(data)
-	v, ok := programMapping[id]
+	id, opt, err := optionSplit(data)
+	var buf []byte
+	var rev int
+	if err == nil {
+		rev, err = revisionParse(opt.Get("revision"))
+	}
+	if err == nil {
+		if archive, _ := strconv.ParseBool(opt.Get("archive")); archive {
+			buf, _, err = programArchive(programIndex(id), rev)
+		} else {
+			buf, err = programSource(programIndex(id), rev, opt.Get("path"))
+		}
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	length := int32Encoder(int32(len(buf)))
+	conn.Write(length)
+	conn.Write(buf)
+	return nil
+}
+
+// listRuns 列出运行记录, 按开始时间降序分页
+// cmd format: "listRuns" + [":" + "?program=" + ID + "&status=" + (running|stoped|lost) + "&since=" + RFC3339 + "&offset=" + N + "&limit=" + N]
+// return: statusErr; length(4 bytes) + JSON({"total", "offset", "runs": [运行记录...]})
+func listRuns(conn net.Conn, data []byte) error {
+	_, opt, err := optionSplit(data)
+	var q runQuery
+	if err == nil {
+		q, err = historyParse(opt)
+	}
+	var buf []byte
+	if err == nil {
+		buf, err = json.Marshal(historyList(q))
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	conn.Write(int32Encoder(int32(len(buf))))
+	conn.Write(buf)
+	return nil
+}
+
+// getRun 获取一条运行记录
+// cmd format: "getRun" + ":" + runID
+// return: statusErr, ID not existed; length(4 bytes) + JSON({"id", "program", "revision", "argv", "status", "code", "start", "end", "outputs", "usage", ...})
+func getRun(conn net.Conn, data []byte) error {
+	v, ok := historyGet(string(data))
 	if !ok {
 		conn.Write(statusErr)
-		return errNoMapping
+		return errNoID
 	}
-	var fileName string
-	switch v.file {
-	case python2, python3:
-		fileName = v.dir + "/main.py"
-	case golang:
-		fileName = v.dir + "main.go"
+	buf, err := json.Marshal(v)
+	if err != nil {
+		conn.Write(statusErr)
+		return err
 	}
-	buf, err := ioutil.ReadFile(fileName)
+	conn.Write(int32Encoder(int32(len(buf))))
+	conn.Write(buf)
+	return nil
+}
+
+// getLog 获取运行的stdout或stderr, 运行结束后与结果保留相同的时间
+// cmd format: "getLog" + ":" + runID + ["?stream=stderr"]
+// return: statusErr, ID not existed; length(4 bytes) + log
+func getLog(conn net.Conn, data []byte) error {
+	id, opt, err := optionSplit(data)
 	if err != nil {
 		conn.Write(statusErr)
 		return err
 	}
-	length := int32Encoder(int32(len(buf)))
-	conn.Write(length)
+	stream := opt.Get("stream")
+	if stream == "" {
+		stream = logStdout
+	}
+	buf, err := logGet(id, stream)
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	conn.Write(int32Encoder(int32(len(buf))))
 	conn.Write(buf)
 	return nil
 }
@@ -361,20 +593,113 @@ func getFile(conn net.Conn, data []byte) error {
 // cmd format: "removeID"+ ":" + ID
 // return: statusErr, ID not existed; statusOK, remove this file successfully
 func fileRemover(conn net.Conn, data []byte) error {
-	id := programIndex(data)
-	if v, ok := programMapping[id]; ok {
-		delete(programMapping, id)
-		os.RemoveAll(v.dir)
-		v.cancel()
-		conn.Write(statusOK)
-		return nil
+	if err := programRemove(programIndex(data)); err != nil {
+		conn.Write(statusErr)
+		return err
 	}
-	conn.Write(statusErr)
-	return errNoID
+	conn.Write(statusOK)
+	return nil
+}
+
+// listPrograms 列出程序, 按创建时间升序分页
+// cmd format: "listPrograms" + [":" + "?language=" + 语言(可重复) + "&offset=" + N + "&limit=" + N]
+// return: statusErr; length(4 bytes) + JSON({"total", "offset", "programs": [{"id", "language", "immediate", "revision", "size", "created", "lastRun", "runs"}]})
+func listPrograms(conn net.Conn, data []byte) error {
+	_, opt, err := optionSplit(data)
+	var q catalogQuery
+	if err == nil {
+		q, err = catalogParse(opt)
+	}
+	var buf []byte
+	if err == nil {
+		buf, err = json.Marshal(programList(q))
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	conn.Write(int32Encoder(int32(len(buf))))
+	conn.Write(buf)
+	return nil
+}
+
+// listRevisions 列出程序的全部版本
+// cmd format: "listRevisions" + ":" + ID
+// return: statusErr, ID not existed; length(4 bytes) + JSON([{"revision", "current", "language", "created", ...}])
+func listRevisions(conn net.Conn, data []byte) error {
+	l, err := revisionList(programIndex(data))
+	var buf []byte
+	if err == nil {
+		buf, err = json.Marshal(l)
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	conn.Write(int32Encoder(int32(len(buf))))
+	conn.Write(buf)
+	return nil
+}
+
+// revisionPromote 将指定版本设为start默认使用的版本, 不影响正在运行的容器
+// cmd format: "promote" + ":" + ID + "?revision=" + 版本号
+// return: statusErr; statusOK
+func revisionPromote(conn net.Conn, data []byte) error {
+	id, opt, err := optionSplit(data)
+	var rev int
+	if err == nil {
+		rev, err = revisionParse(opt.Get("revision"))
+	}
+	if err == nil && rev == 0 {
+		err = errRevisionErr
+	}
+	if err == nil {
+		err = programPromote(programIndex(id), rev)
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	conn.Write(statusOK)
+	return nil
+}
+
+// revisionRollback 回退当前版本, 未指定版本时回退到前一个版本
+// cmd format: "rollback" + ":" + ID + ["?revision=" + 版本号]
+// return: statusErr; statusOK + 回退后的版本号 + "\x00"
+func revisionRollback(conn net.Conn, data []byte) error {
+	id, opt, err := optionSplit(data)
+	var rev int
+	if err == nil {
+		rev, err = revisionParse(opt.Get("revision"))
+	}
+	if err == nil {
+		rev, err = programRollback(programIndex(id), rev)
+	}
+	if err != nil {
+		conn.Write(statusErr)
+		return err
+	}
+	conn.Write(statusOK)
+	conn.Write([]byte(strconv.Itoa(rev) + "\x00"))
+	return nil
 }
 
-func connToID(conn net.Conn) (containerID string) {
-	if id, ok := addressToContainerID[conn.RemoteAddr().String()]; ok {
+// optionSplit 分离命令参数与选项, 选项以"?"开头, 格式同URL查询参数
+func optionSplit(data []byte) (string, url.Values, error) {
+	s := string(data)
+	i := strings.IndexByte(s, '?')
+	if i < 0 {
+		return s, url.Values{}, nil
+	}
+	opt, err := url.ParseQuery(s[i+1:])
+	return s[:i], opt, err
+}
+
+func connToID(conn net.Conn) (runID string) {
+	processLock.RLock()
+	defer processLock.RUnlock()
+	if id, ok := addressToRunID[conn.RemoteAddr().String()]; ok {
 		return id
 	}
 	return ""
@@ -385,7 +710,10 @@ func dbInfoGet(conn net.Conn, data []byte) error {
 	if id == "" {
 		return errNoID
 	}
-	if v, ok := dbListMapping[id]; ok {
+	processLock.RLock()
+	v, ok := dbListMapping[id]
+	processLock.RUnlock()
+	if ok {
 		data, err := json.Marshal(v)
 		if err != nil {
 			conn.Write(statusErr)
@@ -397,41 +725,94 @@ func dbInfoGet(conn net.Conn, data []byte) error {
 	return errNoMapping
 }
 
-func dbInfoRemove(containerID string) {
-	delete(dbListMapping, containerID)
+func dbInfoRemove(runID string) {
+	processLock.Lock()
+	delete(dbListMapping, runID)
+	proxies := proxyMapping[runID]
+	delete(proxyMapping, runID)
+	processLock.Unlock()
+	proxyClose(proxies)
 }
 
+// dataSend
+// cmd format: "send" + ":" + options("&"分隔, URL编码), then length(4 bytes) + data
+// options: "window", 窗口模式: 应答statusOK后附加窗口大小 + "\x00",
+// 之后每收到一个窗口的数据(最后一个窗口可不足)应答一次statusOK, 发送方收到应答后才能继续发送
+// 未设置时接收完全部数据后应答statusOK
+// "name=" + 输出名称, "type=" + MIME类型, 未设置名称时为默认输出
 func dataSend(conn net.Conn, data []byte) error {
 	id := connToID(conn)
 	if id == "" {
 		conn.Write(statusErr)
 		return errNoID
 	}
+	opt, _ := url.ParseQuery(string(data))
+	_, windowed := opt["window"]
+	name, contentType := opt.Get("name"), opt.Get("type")
+	window := conf.Flow.SendWindow
 	conn.Write(statusOK)
-	if v, ok := processMapping[id]; ok {
+	if windowed {
+		conn.Write([]byte(strconv.Itoa(window) + "\x00"))
+	}
+	processLock.RLock()
+	v, ok := processMapping[id]
+	processLock.RUnlock()
+	if ok {
 		data = make([]byte, 4)
-		conn.Read(data)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return err
+		}
 		length := int(binary.BigEndian.Uint32(data))
 		logger.Printf("buffer length: %d\n", length)
-		raw := make([]byte, length)
-		// i := bufferSlice
-		// for ; i <= length; i += bufferSlice {
-		// 	conn.Read(raw[i-bufferSlice : i])
-		// }
-		// if length%bufferSlice != 0 {
-		// 	conn.Read(raw[i-bufferSlice:])
-		// }
-		buf := bytes.NewBuffer(raw) // 改为使用io.CopyN接收数据
-		io.CopyN(buf, conn, int64(length))
+		var raw []byte
+		if v.immediate {
+			if int64(length) > conf.Result.MaxSize {
+				discard := length // 窗口模式下客户端发送一个窗口后等待应答
+				if windowed && discard > window {
+					discard = window
+				}
+				return dataSendFail(conn, id, discard)
+			}
+			raw = make([]byte, 0, length)
+		}
+		// 按窗口大小分段接收, 非立即推送的程序直接写入缓存
+		buf := make([]byte, window)
+		for off := 0; off < length; off += window {
+			n := length - off
+			if n > window {
+				n = window
+			}
+			if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+				return err
+			}
+			if v.immediate {
+				raw = append(raw, buf[:n]...)
+			} else if err := dataStore(id, name, contentType, buf[:n]); err == errResultTooLarge {
+				discard := 0
+				if !windowed {
+					discard = length - off - n
+				}
+				return dataSendFail(conn, id, discard)
+			} else if err != nil {
+				conn.Write(statusErr)
+				return err
+			}
+			if windowed && off+n != length {
+				conn.Write(statusOK)
+			}
+		}
 		conn.Write(statusOK)
 		if v.immediate {
 			mqLock.Lock()
-			mqSend([]byte(fmt.Sprintf("data:%s\x00", id)))
-			mqSend(data)
-			mqSend(raw)
+			eventSend(runEvent{
+				Type:        "data",
+				Program:     v.program,
+				Run:         id,
+				Name:        name,
+				ContentType: contentType,
+				Data:        raw,
+			}, v.origin)
 			mqLock.Unlock()
-		} else {
-			dataStore(id, raw)
 		}
 		logger.Print("Send done\n")
 		return nil
@@ -440,9 +821,70 @@ func dataSend(conn net.Conn, data []byte) error {
 	return errors.New("Stop this process")
 }
 
-func processCancel(containerID string) {
-	if v, ok := processMapping[containerID]; ok {
+// progressSend 无论是否立即推送, 进度均立即推送
+// cmd format: "progress" + ":" + percent(0-100) + ":" + message
+func progressSend(conn net.Conn, data []byte) error {
+	id := connToID(conn)
+	processLock.RLock()
+	v, ok := processMapping[id]
+	processLock.RUnlock()
+	if !ok {
+		conn.Write(statusErr)
+		return errNoID
+	}
+	pct, msg := dataSplit(data)
+	percent, err := strconv.ParseFloat(pct, 64)
+	if err != nil || !(percent >= 0 && percent <= 100) { // 包括NaN
+		conn.Write(statusErr)
+		return errTransferErr
+	}
+	conn.Write(statusOK)
+	eventSend(runEvent{Type: "progress", Program: v.program, Run: id, Progress: percent, Message: string(msg)}, v.origin)
+	return nil
+}
+
+// logSend 算法日志, 立即推送
+// cmd format: "log" + ":" + level(debug, info, warning, error) + ":" + text
+func logSend(conn net.Conn, data []byte) error {
+	id := connToID(conn)
+	processLock.RLock()
+	v, ok := processMapping[id]
+	processLock.RUnlock()
+	if !ok {
+		conn.Write(statusErr)
+		return errNoID
+	}
+	level, text := dataSplit(data)
+	switch level {
+	case "debug", "info", "warning", "error":
+	default:
+		conn.Write(statusErr)
+		return errTransferErr
+	}
+	conn.Write(statusOK)
+	eventSend(runEvent{Type: "log", Program: v.program, Run: id, Level: level, Message: string(text)}, v.origin)
+	return nil
+}
+
+// dataSendFail 结果超出conf.Result.MaxSize, 终止该运行
+// 读取并丢弃客户端在应答前仍会发送的discard字节, 避免被当作下一条命令解析
+func dataSendFail(conn net.Conn, runID string, discard int) error {
+	dataFail(runID)
+	if _, err := io.CopyN(ioutil.Discard, conn, int64(discard)); err != nil {
+		processCancel(runID)
+		return err
+	}
+	conn.Write(statusErr)
+	processCancel(runID)
+	return errResultTooLarge
+}
+
+func processCancel(runID string) {
+	processLock.Lock()
+	v, ok := processMapping[runID]
+	delete(processMapping, runID)
+	processLock.Unlock()
+	if ok {
 		v.cancel()
-		delete(processMapping, containerID)
 	}
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "aaf-log")
+	if err != nil {
+		panic(err)
+	}
+	logger = NewMultiLogger(time.Hour, dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testSetup 以临时目录及模拟运行时初始化全局状态(代替setup), 测试结束后取消ctxRoot
+func testSetup(t testing.TB) *fakeRuntime {
+	t.Helper()
+	storePath = t.TempDir()
+	f := newFakeRuntime()
+	rt = f
+	ctxRoot, ctxRootCancel = context.WithCancel(context.Background())
+	t.Cleanup(ctxRootCancel)
+	programLock.Lock()
+	programMapping = make(map[programIndex]*programEntry)
+	programLock.Unlock()
+	objectLock.Lock()
+	objectRefs = make(map[string]int)
+	objectLock.Unlock()
+	return f
+}
+
+const benchSize = 100 << 20 // 每次迭代传输的字节数
+
+// 容器以窗口模式(send:window)通过回环连接发送100MB结果, 非立即推送的程序写入结果缓存
+func BenchmarkDataSendWindow(b *testing.B) {
+	testSetup(b)
+	chunk := make([]byte, 1<<20)
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server, client := testConnPair(b)
+		runID, _ := newID()
+		processLock.Lock()
+		processMapping[runID] = processInfo{cancel: func() {}}
+		addressToRunID[server.RemoteAddr().String()] = runID
+		processLock.Unlock()
+		done := make(chan error, 1)
+		go func() { done <- dataSend(server, []byte("window")) }()
+		r := bufio.NewReader(client)
+		if s, err := readString(0, r); err != nil || s != "ok" {
+			b.Fatalf("send: %q, %v", s, err)
+		}
+		s, _ := readString(0, r)
+		window, err := strconv.Atoi(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, benchSize)
+		client.Write(length)
+		for off := 0; off < benchSize; {
+			for n := 0; n < window && off < benchSize; { // 发送一个窗口
+				m := len(chunk)
+				if m > window-n {
+					m = window - n
+				}
+				if m > benchSize-off {
+					m = benchSize - off
+				}
+				if _, err = client.Write(chunk[:m]); err != nil {
+					b.Fatal(err)
+				}
+				n += m
+				off += m
+			}
+			if s, err = readString(0, r); err != nil || s != "ok" {
+				b.Fatalf("window ack: %q, %v", s, err)
+			}
+		}
+		if err = <-done; err != nil {
+			b.Fatal(err)
+		}
+		outputs, _ := dataRead(runID)
+		for _, out := range outputs {
+			out.body.Close()
+		}
+		processLock.Lock()
+		delete(processMapping, runID)
+		delete(addressToRunID, server.RemoteAddr().String())
+		processLock.Unlock()
+		server.Close()
+		client.Close()
+	}
+}
+
+// 选项经过URL解码后, 未编码的时区偏移"+08:00"仍可解析
+func TestTimeParseOffset(t *testing.T) {
+	want := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, raw := range []string{"2021-06-01T08:00:00+08:00", "2021-06-01T08:00:00%2B08:00", "2021-06-01T00:00:00Z", "1622505600"} {
+		opt, err := url.ParseQuery("since=" + raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := timeParse(opt.Get("since")); err != nil || !v.Equal(want) {
+			t.Errorf("%s: %v, %v", raw, v, err)
+		}
+		if q, err := historyParse(opt); err != nil || !q.since.Equal(want) {
+			t.Errorf("listRuns %s: %v, %v", raw, q.since, err)
+		}
+	}
+}
+
+// 结果超出result.maxSize后, 客户端仍会发送的数据被丢弃, 同一连接上的下一条命令正常解析
+func TestDataSendOversize(t *testing.T) {
+	testSetup(t)
+	saved := conf
+	defer func() { conf = saved }()
+	conf.Result.MaxSize, conf.Flow.SendWindow = 8, 4
+	for _, c := range []struct {
+		name                string
+		immediate, windowed bool
+	}{
+		{"immediate", true, false},
+		{"immediate window", true, true},
+		{"buffered", false, false},
+		{"buffered window", false, true},
+	} {
+		server, client := testConnPair(t)
+		runID, _ := newID()
+		processLock.Lock()
+		processMapping[runID] = processInfo{cancel: func() {}, immediate: c.immediate}
+		addressToRunID[server.RemoteAddr().String()] = runID
+		processLock.Unlock()
+		next := make(chan string, 1)
+		go tcpConnectHandler(server, map[string]tcpHandlerFunc{
+			"send": dataSend,
+			"ping": func(conn net.Conn, data []byte) error {
+				next <- string(data)
+				_, err := conn.Write(statusOK)
+				return err
+			},
+		})
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(client)
+		cmd := "send:"
+		if c.windowed {
+			cmd += "window"
+		}
+		client.Write([]byte(cmd + "\x00"))
+		if s, err := readString(0, r); err != nil || s != "ok" {
+			t.Fatalf("%s: send: %q, %v", c.name, s, err)
+		}
+		if c.windowed {
+			readString(0, r) // window
+		}
+		const length = 16
+		head := make([]byte, 4)
+		binary.BigEndian.PutUint32(head, length)
+		client.Write(head)
+		status := "ok"
+		for off := 0; off < length && status == "ok"; off += conf.Flow.SendWindow {
+			client.Write(bytes.Repeat([]byte{'x'}, conf.Flow.SendWindow))
+			if c.windowed {
+				status, _ = readString(0, r)
+			}
+		}
+		if !c.windowed {
+			status, _ = readString(0, r)
+		}
+		if status != "error" {
+			t.Fatalf("%s: send status %q, want error", c.name, status)
+		}
+		client.Write([]byte("ping:next\x00"))
+		if s, err := readString(0, r); err != nil || s != "ok" {
+			t.Fatalf("%s: next command: %q, %v", c.name, s, err)
+		}
+		if data := <-next; data != "next" {
+			t.Fatalf("%s: next command data %q", c.name, data)
+		}
+		processLock.Lock()
+		delete(addressToRunID, server.RemoteAddr().String())
+		processLock.Unlock()
+		dataFail(runID)
+	}
+}
+
+// progress与log命令: 百分比超出[0, 100]或级别未知时返回err, 推送的消息经过URL编码
+func TestProgressLogSend(t *testing.T) {
+	testSetup(t)
+	mqReopen(t, t.TempDir())
+	server, client := testConnPair(t)
+	runID, _ := newID()
+	processLock.Lock()
+	processMapping[runID] = processInfo{cancel: func() {}, program: "P"}
+	addressToRunID[server.RemoteAddr().String()] = runID
+	processLock.Unlock()
+	defer func() {
+		processLock.Lock()
+		delete(processMapping, runID)
+		delete(addressToRunID, server.RemoteAddr().String())
+		processLock.Unlock()
+	}()
+	sub := eventSubscribe(eventFilter{run: runID})
+	defer eventUnsubscribe(sub)
+	r := bufio.NewReader(client)
+	for _, c := range []struct {
+		handler tcpHandlerFunc
+		data    string
+		head    string // 为空时应返回err
+	}{
+		{progressSend, "50:step 1: load", "progress:" + runID + ":50:step+1%3A+load\x00"},
+		{progressSend, "0:", "progress:" + runID + ":0:\x00"},
+		{progressSend, "100:done", "progress:" + runID + ":100:done\x00"},
+		{progressSend, "-1:x", ""},
+		{progressSend, "100.5:x", ""},
+		{progressSend, "NaN:x", ""},
+		{progressSend, "Inf:x", ""},
+		{progressSend, "half:x", ""},
+		{logSend, "warning:a:b", "log:" + runID + ":warning:a%3Ab\x00"},
+		{logSend, "info:100%", "log:" + runID + ":info:100%25\x00"},
+		{logSend, "fatal:x", ""},
+		{logSend, "info", "log:" + runID + ":info:\x00"},
+	} {
+		go c.handler(server, []byte(c.data))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		s, err := readString(0, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.head == "" {
+			if s != "error" {
+				t.Errorf("%q: status %q, want error", c.data, s)
+			}
+			continue
+		}
+		if s != "ok" {
+			t.Errorf("%q: status %q, want ok", c.data, s)
+			continue
+		}
+		select {
+		case ev := <-sub.ch:
+			if head := string(ev.legacyHead()); head != c.head {
+				t.Errorf("%q: head %q, want %q", c.data, head, c.head)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: no event", c.data)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	manifestName    = "manifest.json"
+	manifestVersion = 1
+)
+
+var errManifestErr = errors.New("Invalid manifest")
+
+// programManifest 程序的描述, 保存于程序目录的manifest.json
+// 资源限制、超时等选项与programOptions相同, 直接展开在顶层
+type programManifest struct {
+	Version     int       `json:"version"`
+	Revision    int       `json:"revision"`
+	Language    string    `json:"language"` // python2, python3, golang, nodejs, java, cpp
+	Immediate   bool      `json:"immediate"`
+	Description string    `json:"description,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Created     time.Time `json:"created"`
+	SourceHash  string    `json:"sourceHash"` // 上传的源文件或归档的sha256
+	programOptions
+}
+
+func (p programInfo) manifest() programManifest {
+	m := programManifest{
+		Version:        manifestVersion,
+		Revision:       p.revision,
+		Language:       p.file.String(),
+		Immediate:      p.immediate,
+		Description:    p.description,
+		Owner:          p.owner,
+		Created:        p.created,
+		SourceHash:     p.sourceHash,
+		programOptions: p.options,
+	}
+	m.Entrypoint = p.entrypoint()
+	return m
+}
+
+// cfgStore 写入版本目录下的manifest.json
+func (p programInfo) cfgStore() error {
+	buf, err := json.MarshalIndent(p.manifest(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileReplace(p.dir+"/"+manifestName, buf)
+}
+
+// fileReplace 先写入临时文件再重命名, 不会留下不完整的文件
+func fileReplace(path string, buf []byte) error {
+	tmp := filepath.Dir(path) + "/." + filepath.Base(path)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync() // 重命名前同步, 崩溃后不会留下空文件
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// cfgLoader 读取版本目录dir下的manifest.json, 程序ID及版本号取自目录名
+func (p *programInfo) cfgLoader(dir string) error {
+	buf, err := ioutil.ReadFile(dir + "/" + manifestName)
+	if err != nil {
+		return err
+	}
+	m := programManifest{}
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return err
+	}
+	if m.Version != manifestVersion {
+		return errManifestErr
+	}
+	file, ok := fileTypeParse(m.Language)
+	if !ok {
+		return errTypeErr
+	}
+	rev, err := strconv.Atoi(filepath.Base(dir))
+	if err != nil {
+		return errRevisionErr
+	}
+	*p = programInfo{
+		id:          programIndex(filepath.Base(filepath.Dir(dir))),
+		revision:    rev,
+		dir:         dir,
+		file:        file,
+		immediate:   m.Immediate,
+		options:     m.programOptions,
+		description: m.Description,
+		owner:       m.Owner,
+		created:     m.Created,
+		sourceHash:  m.SourceHash,
+	}
+	return nil
+}
+
+// cfgMigrate 将旧格式的配置(2字节的status文件: 语言, 是否立即推送; options.json)转换为manifest.json
+// 创建时间取自程序ID(上传时的Unix时间), 源文件哈希按当前的源文件计算
+func (p *programInfo) cfgMigrate(dir string) error {
+	f, err := os.Open(dir + "/status")
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(f, buf)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	rev, err := strconv.Atoi(filepath.Base(dir))
+	if err != nil {
+		return errRevisionErr
+	}
+	s := programInfo{id: programIndex(filepath.Base(filepath.Dir(dir))), revision: rev, dir: dir}
+	switch buf[0] {
+	case 0:
+		s.file = python2
+	case 1:
+		s.file = python3
+	case 2:
+		s.file = golang
+	case 3:
+		s.file = nodejs
+	case 4:
+		s.file = java
+	case 5:
+		s.file = cpp
+	default:
+		return errTypeErr
+	}
+	s.immediate = buf[1] == 1
+	if buf, err := ioutil.ReadFile(dir + "/options.json"); err == nil {
+		if err = json.Unmarshal(buf, &s.options); err != nil {
+			return err
+		}
+	}
+	if sec, err := strconv.ParseInt(string(s.id), 10, 64); err == nil {
+		s.created = time.Unix(sec, 0)
+	} else if fi, err := os.Stat(dir + "/status"); err == nil {
+		s.created = fi.ModTime()
+	}
+	src := filepath.Join(dir, filepath.FromSlash(s.entrypoint()))
+	if s.options.Archive != "" {
+		src = legacyArchivePath(s)
+	}
+	if s.sourceHash, err = fileHash(src); err != nil {
+		return err
+	}
+	if err = s.cfgStore(); err != nil {
+		return err
+	}
+	os.Remove(dir + "/status")
+	os.Remove(dir + "/options.json")
+	return p.cfgLoader(dir)
+}
+
+// fileHash 文件内容的sha256(hex)
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
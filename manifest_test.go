@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// manifestTestTree 目录下全部文件的内容及修改时间
+func manifestTestTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		tree[path] = fi.ModTime().String() + "\n" + string(buf)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// 基线格式(程序目录中的2字节status文件)迁移为版本1的manifest.json, 再次加载时不做任何修改
+func TestCfgMigrate(t *testing.T) {
+	testSetup(t)
+	const id = "1600000000" // 基线的程序ID为上传时的Unix时间
+	src := "print('hello')\n"
+	dir := storePath + "/" + id
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"status": "\x01\x01", "main.py": src, "driver.py": "# sdk\n"} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, _ := fileHash(dir + "/main.py")
+
+	mapping := make(map[programIndex]*programEntry)
+	IDReader(mapping)
+	e := mapping[id]
+	if e == nil || e.current != 1 || len(e.revisions) != 1 {
+		t.Fatalf("entry %+v", e)
+	}
+	p := e.revisions[1]
+	if p.file != python3 || !p.immediate || p.dir != dir+"/1" || p.sourceHash != hash || !p.created.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("program %+v", p)
+	}
+	buf, err := ioutil.ReadFile(dir + "/1/" + manifestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := programManifest{}
+	if err = json.Unmarshal(buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != manifestVersion || m.Revision != 1 || m.Language != "python3" || !m.Immediate ||
+		m.Entrypoint != "main.py" || m.SourceHash != hash || !m.Created.Equal(p.created) {
+		t.Fatalf("manifest %s", buf)
+	}
+	for _, name := range []string{"/status", "/1/status", "/main.py"} {
+		if pathStat(dir+name) != notExist {
+			t.Errorf("%s not migrated", name)
+		}
+	}
+	for _, name := range []string{"/" + programStateName, "/1/main.py", "/1/driver.py"} {
+		if pathStat(dir+name) != file {
+			t.Errorf("%s missing", name)
+		}
+	}
+
+	before := manifestTestTree(t, storePath)
+	again := make(map[programIndex]*programEntry)
+	IDReader(again)
+	if after := manifestTestTree(t, storePath); len(after) != len(before) {
+		t.Fatalf("second run changed the store: %d files, want %d", len(after), len(before))
+	} else {
+		for path, v := range before {
+			if after[path] != v {
+				t.Errorf("second run modified %s", path)
+			}
+		}
+	}
+	if e := again[id]; e == nil || e.current != 1 || !reflect.DeepEqual(e.revisions[1].manifest(), p.manifest()) {
+		t.Fatalf("second run loaded %+v", e)
+	}
+}
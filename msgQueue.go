@@ -1,65 +1,543 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-type msgNode struct {
-	data []byte
-	next *msgNode
+// 消息队列持久化在storePath/.queue下, 由多个分段文件组成, 文件名为该段第一条消息的序号
+// record format (big endian):
+// seq(8 bytes) + time(8 bytes, unix nano) + metaLen(4 bytes) + dataLen(4 bytes) + crc32(4 bytes) + meta(json) + data
+// 已确认(ack)的序号保存在ack文件中, 未确认的消息在listener重新连接后重新推送
+// 已确认的消息按conf.Queue的保留策略保留, listener可从指定的序号或时间开始重新订阅
+// 写入时只持有当前分段的写入锁, 写入及fsync完成后才在mqMutex下更新索引;
+// 读取时持有分段的引用, 超出保留范围的分段在最后一个引用释放后关闭并删除
+const (
+	walHeaderSize = 28
+	walSuffix     = ".wal"
+	walAckFile    = "ack"
+)
+
+var walSegmentSize int64 = 64 << 20 // 分段写满后新建分段, 测试时调小
+
+type walSegment struct {
+	first uint64
+	path  string
+	file  *os.File
+	size  int64      // 已写入索引的记录大小, 修改时需同时持有lock及mqMutex
+	refs  int        // 队列本身(未被删除时)及未关闭的reader, 需持有mqMutex
+	lock  sync.Mutex // 写入锁
+}
+
+// walReader 消息中的结果数据, 关闭时释放分段的引用
+type walReader struct {
+	*io.SectionReader
+	seg *walSegment
+}
+
+type walEntry struct {
+	seq     uint64
+	time    int64
+	seg     *walSegment
+	offset  int64
+	metaLen uint32
+	dataLen uint32
+}
+
+// mqMessage 待推送的消息, head之后为size字节的body
+type mqMessage struct {
+	seq    uint64
+	head   []byte
+	body   io.ReadCloser
+	size   int64
+	origin frameOrigin
 }
 
 var (
-	connListener      net.Conn
-	mqHead            *msgNode
-	mqTail            *msgNode
-	mqMutex           = sync.Mutex{}
-	pushServiceLocked = false
-	pushLock          = make(chan struct{}, 1)
-	listenerLock      = sync.Mutex{}
+	errWalCorrupt = errors.New("Queue record corrupt")
+
+	connListener   net.Conn
+	listenerAck    = false // listener需要ack
+	listenerWindow int64   // ack模式下允许未确认的最大字节数, 0: 每条消息均等待ack
+	listenerGen    = 0     // listener每次更换时递增
+	listenerLock   = sync.Mutex{}
+	pushLock       = make(chan struct{}, 1)
+
+	mqDir      string
+	mqSegments []*walSegment
+	mqIndex    []walEntry // 按seq连续排列
+	mqAcked    uint64
+	mqLastSeq  uint64
+	mqNext     uint64 // 下一条待推送的seq
+	mqSent     uint64 // 最后一条推送给当前listener的seq
+	mqOrigins  = make(map[uint64]frameOrigin)
+	mqMutex    = sync.Mutex{}
 )
 
-func init() {
-	go mqPush() // start push service
+// mqOpen 打开(或创建)消息队列, 截断崩溃时未写完整的记录
+func mqOpen(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	mqDir = dir
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, walAckFile)); err == nil && len(buf) == 8 {
+		mqAcked = binary.BigEndian.Uint64(buf)
+	}
+	mqLastSeq = mqAcked
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for i := range files {
+		if strings.HasSuffix(files[i].Name(), walSuffix) {
+			names = append(names, files[i].Name())
+		}
+	}
+	sort.Strings(names)
+	corrupt := false
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if corrupt { // 损坏记录之后的分段无法保证连续, 丢弃
+			logger.Printf("Queue segment %s dropped.\n", name)
+			os.Remove(path)
+			continue
+		}
+		var first uint64
+		if _, err := fmt.Sscanf(name, "%020d"+walSuffix, &first); err != nil {
+			continue
+		}
+		seg := &walSegment{first: first, path: path, refs: 1}
+		if seg.file, err = os.OpenFile(path, os.O_RDWR, 0644); err != nil {
+			return err
+		}
+		if corrupt, err = mqScan(seg); err != nil {
+			return err
+		}
+		mqSegments = append(mqSegments, seg)
+	}
+	if mqLastSeq < mqAcked {
+		mqLastSeq = mqAcked
+	}
+	mqNext = mqAcked + 1
+	mqRetain()
+	return nil
+}
+
+// mqScan 读取分段中的记录建立索引
+func mqScan(seg *walSegment) (corrupt bool, err error) {
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err = seg.file.ReadAt(header, offset); err != nil {
+			break
+		}
+		e := walEntry{
+			seq:     binary.BigEndian.Uint64(header[0:8]),
+			time:    int64(binary.BigEndian.Uint64(header[8:16])),
+			seg:     seg,
+			offset:  offset,
+			metaLen: binary.BigEndian.Uint32(header[16:20]),
+			dataLen: binary.BigEndian.Uint32(header[20:24]),
+		}
+		if fi, statErr := seg.file.Stat(); statErr != nil || fi.Size() < offset+walHeaderSize+e.size() {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		crc := crc32.NewIEEE()
+		if _, err = io.Copy(crc, io.NewSectionReader(seg.file, offset+walHeaderSize, e.size())); err != nil {
+			break
+		}
+		if crc.Sum32() != binary.BigEndian.Uint32(header[24:28]) ||
+			(len(mqIndex) != 0 && e.seq != mqLastSeq+1) {
+			err = errWalCorrupt
+			break
+		}
+		mqIndex = append(mqIndex, e)
+		mqLastSeq = e.seq
+		offset += walHeaderSize + e.size()
+	}
+	seg.size = offset
+	if fi, e := seg.file.Stat(); e == nil && fi.Size() != offset {
+		logger.Printf("Queue segment %s truncated at %d: %v.\n", seg.path, offset, err)
+		corrupt = true
+		if e = seg.file.Truncate(offset); e != nil {
+			return corrupt, e
+		}
+	}
+	return corrupt, nil
 }
 
-func mqSend(data []byte) {
-	node := &msgNode{
-		data: data,
-		next: nil,
+// mqSend 持久化消息并通知推送服务, 返回消息序号
+// 消息数据从ev.body(Size bytes)流式写入, 为nil时写入ev.Data
+// 写入及fsync期间只持有分段的写入锁, 不阻塞ack、推送及订阅
+func mqSend(ev runEvent, origin frameOrigin) (uint64, error) {
+	body := ev.body
+	if body == nil {
+		body = bytes.NewReader(ev.Data)
+		ev.Size = int64(len(ev.Data))
+	}
+	ev.Data = nil
+	seg, seq, err := mqWriter()
+	if err != nil {
+		return 0, err
+	}
+	defer seg.lock.Unlock()
+	ev.Seq = seq
+	meta, err := json.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+	// 先写入数据, 再写入包含crc的header
+	crc := crc32.NewIEEE() // 覆盖meta + data, 与mqScan一致
+	if _, err = seg.file.Seek(seg.size+walHeaderSize, io.SeekStart); err == nil {
+		w := io.MultiWriter(seg.file, crc)
+		if _, err = w.Write(meta); err == nil {
+			_, err = io.CopyN(w, body, ev.Size)
+		}
+	}
+	if err == nil {
+		header := make([]byte, walHeaderSize)
+		binary.BigEndian.PutUint64(header[0:8], seq)
+		binary.BigEndian.PutUint64(header[8:16], uint64(ev.Time.UnixNano()))
+		binary.BigEndian.PutUint32(header[16:20], uint32(len(meta)))
+		binary.BigEndian.PutUint32(header[20:24], uint32(ev.Size))
+		binary.BigEndian.PutUint32(header[24:28], crc.Sum32())
+		if _, err = seg.file.WriteAt(header, seg.size); err == nil {
+			err = seg.file.Sync()
+		}
+	}
+	if err != nil {
+		seg.file.Truncate(seg.size)
+		return 0, err
+	}
+	e := walEntry{
+		seq:     seq,
+		time:    ev.Time.UnixNano(),
+		seg:     seg,
+		offset:  seg.size,
+		metaLen: uint32(len(meta)),
+		dataLen: uint32(ev.Size),
 	}
 	mqMutex.Lock()
-	if mqHead == nil {
-		mqHead = node
-		pushLock <- struct{}{}
-	} else {
-		mqTail.next = node
+	mqIndex = append(mqIndex, e)
+	seg.size += walHeaderSize + e.size()
+	mqLastSeq = seq
+	if origin.w != nil {
+		mqOrigins[seq] = origin
 	}
-	mqTail = node
+	mqNotify()
 	mqMutex.Unlock()
+	return seq, nil
 }
 
-// mqPush plz call this function with go routine
-func mqPush() {
+// mqWriter 获取当前分段的写入锁及下一条消息的序号
+// 持有写入锁期间其他消息无法写入索引, 当前分段不会改变, 序号连续
+func mqWriter() (*walSegment, uint64, error) {
 	for {
 		mqMutex.Lock()
-		listenerLock.Lock()
-		if mqHead == nil || connListener == nil {
-			pushServiceLocked = true
-			listenerLock.Unlock()
+		seg, err := mqActiveSegment(mqLastSeq + 1)
+		mqMutex.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+		seg.lock.Lock()
+		mqMutex.Lock()
+		active := mqSegments[len(mqSegments)-1] == seg && seg.size < walSegmentSize
+		seq := mqLastSeq + 1
+		mqMutex.Unlock()
+		if active {
+			return seg, seq, nil
+		}
+		seg.lock.Unlock() // 等待期间已写满, 写入新的分段
+	}
+}
+
+// mqActiveSegment 获取可写入的分段, 超过walSegmentSize时新建分段, 需持有mqMutex
+func mqActiveSegment(seq uint64) (*walSegment, error) {
+	if l := len(mqSegments); l != 0 && mqSegments[l-1].size < walSegmentSize {
+		return mqSegments[l-1], nil
+	}
+	path := filepath.Join(mqDir, fmt.Sprintf("%020d"+walSuffix, seq))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &walSegment{first: seq, path: path, file: f, refs: 1}
+	mqSegments = append(mqSegments, seg)
+	mqRetain()
+	return seg, nil
+}
+
+// release 释放分段的引用, 最后一个引用释放后关闭并删除文件, 需持有mqMutex
+func (seg *walSegment) release() {
+	if seg.refs--; seg.refs == 0 {
+		seg.file.Close()
+		os.Remove(seg.path)
+	}
+}
+
+func (r walReader) Close() error {
+	mqMutex.Lock()
+	r.seg.release()
+	mqMutex.Unlock()
+	return nil
+}
+
+// mqEntry 需持有mqMutex
+func mqEntry(seq uint64) (walEntry, bool) {
+	if len(mqIndex) == 0 || seq < mqIndex[0].seq || seq-mqIndex[0].seq >= uint64(len(mqIndex)) {
+		return walEntry{}, false
+	}
+	return mqIndex[seq-mqIndex[0].seq], true
+}
+
+func (e walEntry) size() int64 {
+	return int64(e.metaLen) + int64(e.dataLen)
+}
+
+// mqInflight 已推送但未确认的消息大小, 需持有mqMutex
+// 超出结果上限的消息(限制之前写入)在帧模式下被跳过, 不计入, 避免等待永远不会到来的ack
+func mqInflight() (n int64) {
+	for seq := mqAcked + 1; seq <= mqSent; seq++ {
+		if e, ok := mqEntry(seq); ok && int64(e.dataLen) <= frameMaxLength-frameHeadMax {
+			n += e.size()
+		}
+	}
+	return
+}
+
+// mqRead 从磁盘读取消息并获取分段的引用, 需持有mqMutex
+// 结果数据通过返回的body读取, 读取完成后需关闭body
+func mqRead(e walEntry) (ev runEvent, body io.ReadCloser, err error) {
+	meta := make([]byte, e.metaLen)
+	if _, err = e.seg.file.ReadAt(meta, e.offset+walHeaderSize); err != nil {
+		return
+	}
+	if err = json.Unmarshal(meta, &ev); err != nil {
+		return
+	}
+	if ev.Run == "" { // 旧版本写入的消息, 运行ID为容器ID
+		legacy := struct {
+			Container string `json:"container"`
+		}{}
+		json.Unmarshal(meta, &legacy)
+		ev.Run = legacy.Container
+	}
+	e.seg.refs++
+	body = walReader{io.NewSectionReader(e.seg.file, e.offset+walHeaderSize+int64(e.metaLen), int64(e.dataLen)), e.seg}
+	return
+}
+
+// mqData 读取消息中的结果数据, 读取完成后需关闭, 消息已超出保留范围时返回errNoMapping
+func mqData(seq uint64) (io.ReadCloser, int64, error) {
+	mqMutex.Lock()
+	defer mqMutex.Unlock()
+	e, ok := mqEntry(seq)
+	if !ok {
+		return nil, 0, errNoMapping
+	}
+	_, body, err := mqRead(e)
+	return body, int64(e.dataLen), err
+}
+
+// mqAck 确认seq及之前的所有消息
+func mqAck(seq uint64) error {
+	mqMutex.Lock()
+	defer mqMutex.Unlock()
+	if seq > mqLastSeq {
+		seq = mqLastSeq
+	}
+	if seq <= mqAcked {
+		return nil
+	}
+	for s := mqAcked + 1; s <= seq; s++ {
+		delete(mqOrigins, s)
+	}
+	mqAcked = seq
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	tmp := filepath.Join(mqDir, walAckFile+".tmp")
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(mqDir, walAckFile)); err != nil {
+		return err
+	}
+	mqRetain()
+	mqNotify()
+	return nil
+}
+
+// mqRetain 删除超出保留时间或空间的分段, 需持有mqMutex
+// 正在写入的分段及含有未确认消息的分段不会被删除
+func mqRetain() {
+	var total int64
+	for _, seg := range mqSegments {
+		total += seg.size
+	}
+	deadline := time.Now().Add(-conf.Queue.RetentionAge.Duration).UnixNano()
+	for len(mqSegments) > 1 {
+		last := mqSegments[1].first - 1
+		if last > mqAcked {
+			return
+		}
+		if e, ok := mqEntry(last); ok && e.time >= deadline && total <= conf.Queue.RetentionBytes {
+			return
+		}
+		seg := mqSegments[0]
+		total -= seg.size
+		seg.release() // 正在读取时在reader关闭后删除
+		mqSegments = mqSegments[1:]
+		i := 0
+		for i < len(mqIndex) && mqIndex[i].seg == seg {
+			i++
+		}
+		mqIndex = mqIndex[i:]
+	}
+}
+
+// mqSeek 获取时间不早于t的第一条消息的seq, 需持有mqMutex
+func mqSeek(t time.Time) uint64 {
+	n := t.UnixNano()
+	i := sort.Search(len(mqIndex), func(i int) bool {
+		return mqIndex[i].time >= n
+	})
+	if i == len(mqIndex) {
+		return mqLastSeq + 1
+	}
+	return mqIndex[i].seq
+}
+
+// mqEvents 依次读取序号为from至to的消息(不含结果数据), 超出保留范围的消息被跳过, fn返回false时停止
+func mqEvents(from, to uint64, fn func(runEvent) bool) {
+	for seq := from; seq <= to; seq++ {
+		mqMutex.Lock()
+		if len(mqIndex) != 0 && seq < mqIndex[0].seq {
+			seq = mqIndex[0].seq
+		}
+		e, ok := mqEntry(seq)
+		if !ok || seq > to {
 			mqMutex.Unlock()
+			return
+		}
+		ev, _, err := mqRead(e)
+		if err == nil { // 不读取结果数据
+			e.seg.release()
+		}
+		mqMutex.Unlock()
+		if err != nil {
+			continue
+		}
+		if !fn(ev) {
+			return
+		}
+	}
+}
+
+func mqNotify() {
+	select {
+	case pushLock <- struct{}{}:
+	default:
+	}
+}
+
+// mqNextMessage 获取下一条需推送的消息, 无消息或等待ack时返回false
+func mqNextMessage() (conn net.Conn, msg *mqMessage, ack bool, gen int, ok bool) {
+	mqMutex.Lock()
+	defer mqMutex.Unlock()
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	if connListener == nil || mqNext > mqLastSeq {
+		return
+	}
+	e, found := mqEntry(mqNext)
+	if found && listenerAck && mqSent > mqAcked && mqInflight()+e.size() > listenerWindow { // 超出窗口, 等待ack
+		return
+	}
+	if !found { // 已超出保留范围
+		if len(mqIndex) != 0 && mqNext < mqIndex[0].seq {
+			mqNext = mqIndex[0].seq
+			mqNotify()
+		} else {
+			mqNext = mqLastSeq + 1
+		}
+		return
+	}
+	ev, body, err := mqRead(e)
+	if err != nil {
+		logger.Printf("Queue read %d: %v.\n", e.seq, err)
+		mqNext++
+		return
+	}
+	return connListener, &mqMessage{
+		seq:    e.seq,
+		head:   ev.legacyHead(),
+		body:   body,
+		size:   int64(e.dataLen),
+		origin: mqOrigins[e.seq],
+	}, listenerAck, listenerGen, true
+}
+
+// mqPush plz call this function with go routine
+func mqPush() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		conn, msg, ack, gen, ok := mqNextMessage()
+		if !ok {
 			select {
 			case <-ctxRoot.Done():
 				return
+			case <-ticker.C:
+				mqMutex.Lock()
+				mqRetain()
+				mqMutex.Unlock()
+				continue
 			case <-pushLock:
 				continue
 			}
 		}
-		statusSend(connListener, mqHead.data)
-		mqHead = mqHead.next
+		if ack {
+			msg.head = append([]byte(fmt.Sprintf("seq:%d\x00", msg.seq)), msg.head...)
+		}
+		err := statusSend(conn, msg)
+		if err == errFrameTooLarge { // 无法作为一个frame发送(限制结果大小之前写入的消息), 跳过, 连接不受影响
+			logger.Printf("Listener push %d: %v, skipped.\n", msg.seq, err)
+		} else if err != nil { // listener断开, 等待重新连接后重新推送
+			logger.Printf("Listener push %d: %v.\n", msg.seq, err)
+			listenerLock.Lock()
+			if listenerGen == gen && connListener != nil {
+				connListener.Close()
+				connListener = nil
+			}
+			listenerLock.Unlock()
+			continue
+		}
+		mqMutex.Lock()
+		listenerLock.Lock()
+		if listenerGen == gen {
+			mqNext = msg.seq + 1
+			mqSent = msg.seq
+		}
 		listenerLock.Unlock()
 		mqMutex.Unlock()
+		if !ack {
+			mqAck(msg.seq)
+		}
 	}
 }
 
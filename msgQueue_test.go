@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mqReopen 模拟重启: 关闭分段文件, 清空内存中的队列及listener状态后重新打开
+func mqReopen(t testing.TB, dir string) {
+	t.Helper()
+	mqMutex.Lock()
+	for _, seg := range mqSegments {
+		seg.file.Close()
+	}
+	mqSegments, mqIndex = nil, nil
+	mqAcked, mqLastSeq, mqNext, mqSent = 0, 0, 0, 0
+	mqOrigins = make(map[uint64]frameOrigin)
+	mqMutex.Unlock()
+	listenerLock.Lock()
+	connListener, listenerAck, listenerWindow = nil, false, 0
+	listenerLock.Unlock()
+	if err := mqOpen(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mqTestSend 写入一条data消息, 数据为"msg" + i
+func mqTestSend(t *testing.T, i int) uint64 {
+	t.Helper()
+	seq, err := mqSend(runEvent{Type: "data", Run: "R", Data: []byte("msg" + strconv.Itoa(i)), Time: time.Now()}, frameOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+// mqTestData 检查seq的数据
+func mqTestData(t *testing.T, seq uint64, want string) {
+	t.Helper()
+	body, _, err := mqData(seq)
+	if err != nil {
+		t.Fatalf("seq %d: %v", seq, err)
+	}
+	defer body.Close()
+	if b, _ := ioutil.ReadAll(body); !bytes.Equal(b, []byte(want)) {
+		t.Fatalf("seq %d: got %q, want %q", seq, b, want)
+	}
+}
+
+func TestMqReopen(t *testing.T) {
+	testSetup(t)
+	dir := t.TempDir()
+	mqReopen(t, dir)
+	for i := 1; i <= 3; i++ {
+		mqTestSend(t, i)
+	}
+	if err := mqAck(1); err != nil {
+		t.Fatal(err)
+	}
+	mqReopen(t, dir)
+	if len(mqIndex) != 3 || mqLastSeq != 3 || mqAcked != 1 || mqNext != 2 {
+		t.Fatalf("index %d, last %d, acked %d, next %d", len(mqIndex), mqLastSeq, mqAcked, mqNext)
+	}
+	for i := 1; i <= 3; i++ {
+		mqTestData(t, uint64(i), "msg"+strconv.Itoa(i))
+	}
+	if seq := mqTestSend(t, 4); seq != 4 {
+		t.Fatalf("seq after reopen %d, want 4", seq)
+	}
+}
+
+// testConnPair 回环TCP连接, 返回服务端及客户端
+func testConnPair(t testing.TB) (server, client net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	if client, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server = <-accepted; server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return
+}
+
+// mqTestPush 启动推送服务, 测试结束时等待其退出, 避免影响之后的测试
+func mqTestPush(t testing.TB) {
+	done := make(chan struct{})
+	go func() {
+		mqPush()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		ctxRootCancel()
+		mqNotify()
+		<-done
+	})
+}
+
+// mqTestListen 以选项opt注册listener
+func mqTestListen(t testing.TB, opt string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	server, client := testConnPair(t)
+	r := bufio.NewReader(client)
+	go statusListenRegister(server, []byte(opt))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if s, err := readString(0, r); err != nil || s != "ok" {
+		t.Fatalf("listen: %q, %v", s, err)
+	}
+	return client, r
+}
+
+// mqTestRecv 读取一条ack模式下推送的data消息
+func mqTestRecv(t *testing.T, conn net.Conn, r *bufio.Reader) (uint64, string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, err := readString(0, r)
+	if err != nil || !strings.HasPrefix(s, "seq:") {
+		t.Fatalf("seq head: %q, %v", s, err)
+	}
+	seq, _ := strconv.ParseUint(s[4:], 10, 64)
+	if s, err = readString(0, r); err != nil || s != "data:R" {
+		t.Fatalf("data head: %q, %v", s, err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, binary.BigEndian.Uint32(buf))
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return seq, string(buf)
+}
+
+// mqTestExpect 依次接收seq为from到to的消息, 每条消息接收后确认, ack为false时不确认最后一条
+func mqTestExpect(t *testing.T, conn net.Conn, r *bufio.Reader, from, to uint64, ack bool) {
+	t.Helper()
+	for want := from; want <= to; want++ {
+		seq, data := mqTestRecv(t, conn, r)
+		if seq != want || data != "msg"+strconv.FormatUint(want, 10) {
+			t.Fatalf("got seq %d %q, want %d", seq, data, want)
+		}
+		if want == to && !ack {
+			break
+		}
+		if err := mqAck(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 崩溃时最后一条记录只写入了一部分, 重新打开时截断该记录, 之前的记录完好
+func TestMqHalfWrittenRecord(t *testing.T) {
+	testSetup(t)
+	dir := t.TempDir()
+	mqReopen(t, dir)
+	mqTestSend(t, 1)
+	mqTestSend(t, 2)
+	seg := mqSegments[0]
+	size := seg.size
+	mqTestSend(t, 3)
+	// 保留第3条记录的header及部分数据
+	if err := os.Truncate(seg.path, size+walHeaderSize+5); err != nil {
+		t.Fatal(err)
+	}
+	mqReopen(t, dir)
+	if len(mqIndex) != 2 || mqLastSeq != 2 {
+		t.Fatalf("index %d, last %d", len(mqIndex), mqLastSeq)
+	}
+	if fi, err := os.Stat(seg.path); err != nil || fi.Size() != size {
+		t.Fatalf("segment not truncated to %d: %v", size, err)
+	}
+	mqTestData(t, 1, "msg1")
+	mqTestData(t, 2, "msg2")
+	if seq := mqTestSend(t, 3); seq != 3 {
+		t.Fatalf("seq after truncate %d, want 3", seq)
+	}
+	mqReopen(t, dir)
+	mqTestData(t, 3, "msg3")
+}
+
+// listener在确认前断开, 新的listener从mqAcked+1开始重新接收
+func TestMqListenerDrop(t *testing.T) {
+	testSetup(t)
+	mqReopen(t, t.TempDir())
+	mqTestPush(t)
+	for i := 1; i <= 3; i++ {
+		mqTestSend(t, i)
+	}
+	conn, r := mqTestListen(t, "ack")
+	mqTestExpect(t, conn, r, 1, 2, false)
+	conn.Close()
+	conn, r = mqTestListen(t, "ack")
+	mqTestExpect(t, conn, r, 2, 3, true)
+	mqTestSend(t, 4)
+	mqTestExpect(t, conn, r, 4, 4, true)
+}
+
+// 确认的序号在重启后保留, 重启后只推送未确认的消息
+func TestMqAckPersist(t *testing.T) {
+	testSetup(t)
+	dir := t.TempDir()
+	mqReopen(t, dir)
+	for i := 1; i <= 3; i++ {
+		mqTestSend(t, i)
+	}
+	if err := mqAck(2); err != nil {
+		t.Fatal(err)
+	}
+	mqReopen(t, dir)
+	if mqAcked != 2 {
+		t.Fatalf("acked %d after reopen, want 2", mqAcked)
+	}
+	mqTestPush(t)
+	conn, r := mqTestListen(t, "ack")
+	mqTestExpect(t, conn, r, 3, 3, true)
+	mqTestSend(t, 4)
+	mqTestExpect(t, conn, r, 4, 4, true)
+}
+
+// listener以ack模式(listen:ack&window=8MB)通过回环连接接收100MB结果(100条1MB的消息), 每条消息接收后确认
+func BenchmarkMqPushAckWindow(b *testing.B) {
+	testSetup(b)
+	mqReopen(b, b.TempDir())
+	mqTestPush(b)
+	data := make([]byte, 1<<20)
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < benchSize/len(data); j++ { // 无listener时只写入队列
+			if _, err := mqSend(runEvent{Type: "data", Run: "R", Data: data, Time: time.Now()}, frameOrigin{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		conn, r := mqTestListen(b, "ack&window=8388608")
+		conn.SetReadDeadline(time.Time{})
+		for j := 0; j < benchSize/len(data); j++ {
+			s, err := readString(0, r)
+			if err != nil || !strings.HasPrefix(s, "seq:") {
+				b.Fatalf("seq head: %q, %v", s, err)
+			}
+			if _, err = readString(0, r); err != nil {
+				b.Fatal(err)
+			}
+			length := make([]byte, 4)
+			if _, err = io.ReadFull(r, length); err != nil {
+				b.Fatal(err)
+			}
+			if _, err = io.CopyN(ioutil.Discard, r, int64(binary.BigEndian.Uint32(length))); err != nil {
+				b.Fatal(err)
+			}
+			if err = statusAck(conn, []byte(s[4:])); err != nil {
+				b.Fatal(err)
+			}
+		}
+		listenerLock.Lock() // 断开listener, 之后写入的消息不推送
+		connListener = nil
+		listenerLock.Unlock()
+		conn.Close()
+	}
+}
+
+// 写入结果数据期间(持有分段的写入锁)不阻塞ack及读取
+func TestMqSendOutsideLock(t *testing.T) {
+	testSetup(t)
+	mqReopen(t, t.TempDir())
+	mqTestSend(t, 1)
+	r, w := io.Pipe()
+	done := make(chan uint64, 1)
+	go func() {
+		seq, err := mqSend(runEvent{Type: "data", Run: "R", body: r, Size: 4, Time: time.Now()}, frameOrigin{})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- seq
+	}()
+	w.Write([]byte("ms")) // 写入进行中
+	acked := make(chan error, 1)
+	go func() { acked <- mqAck(1) }()
+	select {
+	case err := <-acked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ack blocked by a pending send")
+	}
+	mqTestData(t, 1, "msg1")
+	w.Write([]byte("g2"))
+	if seq := <-done; seq != 2 {
+		t.Fatalf("seq %d, want 2", seq)
+	}
+	mqTestData(t, 2, "msg2")
+}
+
+// 并发写入的消息序号连续, 重新打开后记录完整
+func TestMqSendConcurrent(t *testing.T) {
+	testSetup(t)
+	dir := t.TempDir()
+	mqReopen(t, dir)
+	size := walSegmentSize
+	walSegmentSize = 256 // 每个分段只能容纳少量消息
+	defer func() { walSegmentSize = size }()
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			var err error
+			for j := 0; j < 10 && err == nil; j++ {
+				_, err = mqSend(runEvent{Type: "data", Run: "R", Data: []byte("msg"), Time: time.Now()}, frameOrigin{})
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	mqReopen(t, dir)
+	if len(mqSegments) < 2 || len(mqIndex) != n*10 || mqLastSeq != n*10 {
+		t.Fatalf("segments %d, index %d, last %d", len(mqSegments), len(mqIndex), mqLastSeq)
+	}
+	for seq := uint64(1); seq <= n*10; seq++ {
+		mqTestData(t, seq, "msg")
+	}
+}
+
+// 超出保留范围的分段在正在读取的结果数据关闭后才被删除
+func TestMqRetainReader(t *testing.T) {
+	testSetup(t)
+	mqReopen(t, t.TempDir())
+	size, queue := walSegmentSize, conf.Queue
+	walSegmentSize, conf.Queue.RetentionBytes = 1, 0 // 每条消息一个分段, 确认后即删除
+	defer func() { walSegmentSize, conf.Queue = size, queue }()
+	for i := 1; i <= 3; i++ {
+		mqTestSend(t, i)
+	}
+	body, _, err := mqData(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := mqSegments[0].path
+	if err = mqAck(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(mqSegments) != 1 {
+		t.Fatalf("%d segments retained, want 1", len(mqSegments))
+	}
+	if _, _, err = mqData(1); err != errNoMapping {
+		t.Fatalf("seq 1 after retention: %v", err)
+	}
+	if b, err := ioutil.ReadAll(body); err != nil || string(b) != "msg1" {
+		t.Fatalf("read after retention: %q, %v", b, err)
+	}
+	body.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("segment %s not removed: %v", path, err)
+	}
+}
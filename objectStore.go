@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 上传的源文件及归档按sha256保存于storePath/.objects/哈希前2位/哈希, 相同内容只保存一份
+// 单文件程序的版本目录中的源文件为对象的硬链接(不支持时为副本), 归档直接从对象解压
+// 对象在启动加载时及每次运行前校验, 被所有版本引用的次数为0时删除
+
+var (
+	errSourceCorrupt = errors.New("Source integrity check failed")
+	objectLock       = sync.Mutex{}
+	objectRefs       = make(map[string]int) // 哈希 -> 引用该对象的版本数
+)
+
+func objectPath(hash string) string {
+	return storePath + "/.objects/" + hash[:2] + "/" + hash
+}
+
+// objectPut 保存src的length字节, 返回其sha256并增加一次引用
+// 内容已存在且完好时丢弃新写入的副本
+func objectPut(src io.Reader, length int64) (string, error) {
+	if err := os.MkdirAll(storePath+"/.objects", 0755); err != nil {
+		io.CopyN(ioutil.Discard, src, length)
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(storePath+"/.objects", ".upload")
+	if err != nil {
+		io.CopyN(ioutil.Discard, src, length)
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tmp, h), src, length)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	objectLock.Lock()
+	defer objectLock.Unlock()
+	if objectVerify(hash) != nil {
+		if err = objectStore(tmp.Name(), hash); err != nil {
+			return "", err
+		}
+	}
+	objectRefs[hash]++
+	return hash, nil
+}
+
+// objectStore 将文件src移动为对象hash, 对象只读
+func objectStore(src, hash string) error {
+	dst := objectPath(hash)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(src, 0444); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// objectVerify 检查对象存在且内容与哈希一致
+func objectVerify(hash string) error {
+	h, err := fileHash(objectPath(hash))
+	if err != nil {
+		return err
+	}
+	if h != hash {
+		return errSourceCorrupt
+	}
+	return nil
+}
+
+// objectLink 在dst创建对象的硬链接, 失败时复制
+func objectLink(hash, dst string) error {
+	os.Remove(dst)
+	if os.Link(objectPath(hash), dst) == nil {
+		return nil
+	}
+	src, err := os.Open(objectPath(hash))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0444)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// objectRelease 减少一次引用, 为0时删除对象
+func objectRelease(hash string) {
+	objectLock.Lock()
+	defer objectLock.Unlock()
+	if objectRefs[hash]--; objectRefs[hash] > 0 {
+		return
+	}
+	delete(objectRefs, hash)
+	os.Remove(objectPath(hash))
+}
+
+// sourceVerify 运行前校验版本的源文件(单文件程序)或上传的归档
+func (p programInfo) sourceVerify() error {
+	name := objectPath(p.sourceHash)
+	if p.options.Archive == "" {
+		name = filepath.Join(p.dir, filepath.FromSlash(p.entrypoint()))
+	}
+	h, err := fileHash(name)
+	if err != nil || h != p.sourceHash {
+		return errSourceCorrupt
+	}
+	return nil
+}
+
+// sourceCheck 加载版本时校验并修复: 对象缺失时从旧的归档或版本目录中的源文件导入,
+// 对象损坏时用完好的源文件恢复, 源文件被修改时从对象恢复; 两者均不可用时返回errSourceCorrupt
+// 成功后增加一次引用
+func (p programInfo) sourceCheck() error {
+	if p.sourceHash == "" {
+		return errSourceCorrupt
+	}
+	source := filepath.Join(p.dir, filepath.FromSlash(p.entrypoint()))
+	if p.options.Archive != "" {
+		source = legacyArchivePath(p)
+	}
+	sourceOK := false
+	if h, err := fileHash(source); err == nil && h == p.sourceHash {
+		sourceOK = true
+	}
+	objectLock.Lock()
+	defer objectLock.Unlock()
+	if err := objectVerify(p.sourceHash); err != nil {
+		if !sourceOK {
+			return errSourceCorrupt
+		}
+		if err = objectImport(source, p.sourceHash); err != nil {
+			return err
+		}
+	}
+	if p.options.Archive != "" {
+		os.Remove(legacyArchivePath(p))
+	} else if !sourceOK {
+		logger.Printf("Program: %s revision %d: source modified, restored.\n", p.id, p.revision)
+		if err := objectLink(p.sourceHash, source); err != nil {
+			return err
+		}
+	}
+	objectRefs[p.sourceHash]++
+	return nil
+}
+
+// objectImport 将已校验的文件source导入为对象hash, source本身保留
+func objectImport(source, hash string) error {
+	if err := os.MkdirAll(storePath+"/.objects", 0755); err != nil {
+		return err
+	}
+	tmp := storePath + "/.objects/.import-" + hash
+	os.Remove(tmp)
+	if os.Link(source, tmp) != nil {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		w, err := os.Create(tmp)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if e := w.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	os.Remove(objectPath(hash))
+	if err := objectStore(tmp, hash); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// objectTestRefs 对象的引用次数
+func objectTestRefs(hash string) int {
+	objectLock.Lock()
+	defer objectLock.Unlock()
+	return objectRefs[hash]
+}
+
+// 内容相同的两个程序共用一个对象, 全部删除后引用为0, 对象随之删除
+func TestObjectShared(t *testing.T) {
+	testSetup(t)
+	src := "print('hello')\n"
+	var programs []programInfo
+	for i := 0; i < 2; i++ {
+		p, err := programCreate(programInfo{file: python3}, strings.NewReader(src), int64(len(src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		programs = append(programs, p)
+	}
+	hash := programs[0].sourceHash
+	if programs[1].sourceHash != hash || objectTestRefs(hash) != 2 {
+		t.Fatalf("hashes %s %s, refs %d", hash, programs[1].sourceHash, objectTestRefs(hash))
+	}
+	objects, _ := filepath.Glob(storePath + "/.objects/*/*")
+	if len(objects) != 1 || objects[0] != objectPath(hash) {
+		t.Fatalf("objects %v", objects)
+	}
+	for _, p := range programs {
+		if err := p.sourceVerify(); err != nil {
+			t.Fatalf("%s: %v", p.id, err)
+		}
+	}
+
+	if err := programRemove(programs[0].id); err != nil {
+		t.Fatal(err)
+	}
+	if objectTestRefs(hash) != 1 || objectVerify(hash) != nil {
+		t.Fatalf("after first remove: refs %d, object %v", objectTestRefs(hash), objectVerify(hash))
+	}
+	if err := programs[1].sourceVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := programRemove(programs[1].id); err != nil {
+		t.Fatal(err)
+	}
+	objectLock.Lock()
+	_, ok := objectRefs[hash]
+	objectLock.Unlock()
+	if ok || pathStat(objectPath(hash)) != notExist {
+		t.Fatal("object not removed when unreferenced")
+	}
+}
+
+// 源文件或归档对象被修改后sourceVerify失败, 不再启动运行
+func TestSourceVerifyTampered(t *testing.T) {
+	testSetup(t)
+	src := "print('hello')\n"
+	single, err := programCreate(programInfo{file: python3}, strings.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := archiveTestWrite(t, archiveTgz, []archiveTestEntry{{name: "main.py", body: src}})
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := f.Stat()
+	packed, err := programCreate(programInfo{file: python3, options: programOptions{Archive: archiveTgz}}, f, fi.Size())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		p    programInfo
+		path string
+	}{
+		{"source", single, filepath.Join(single.dir, "main.py")},
+		{"archive object", packed, objectPath(packed.sourceHash)},
+	} {
+		if err = c.p.sourceVerify(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		os.Chmod(c.path, 0644)
+		if err = ioutil.WriteFile(c.path, []byte("print('tampered')\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.p.sourceVerify(); err != errSourceCorrupt {
+			t.Errorf("%s: sourceVerify %v, want %v", c.name, err, errSourceCorrupt)
+		}
+		if _, err = runStart(c.p.id, 0, "", nil, programOptions{}, frameOrigin{}); err != errSourceCorrupt {
+			t.Errorf("%s: runStart %v, want %v", c.name, err, errSourceCorrupt)
+		}
+	}
+}
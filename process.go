@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 程序的检查与运行, 通过rt(containerRuntime)在沙箱中执行
+
+var (
+	dbPorts   = map[string]string{"mysql": "3306", "sqlserver": "1433", "influxdb": "8086"}
+	proxyNext uint32 // 下一个尝试的转发端口的偏移
+)
+
+// checkRunCmd 在沙箱中安装依赖并检查代码, 成功且ref不为空时将沙箱提交为镜像ref
+func checkRunCmd(p programInfo, ref string) error {
+	ctx := context.Background()
+	file, dir, entry := p.file, p.dir, p.entrypoint()
+	cmd := []string{"sh", "-c"}
+	switch file {
+	case python2:
+		cmd = append(cmd, "pip2 install -r requirements.txt && pylint --output-format=json --errors-only "+entry)
+	case python3:
+		cmd = append(cmd, "pip3 install -r requirements.txt && pylint --output-format=json --errors-only "+entry)
+	case nodejs:
+		cmd = append(cmd, "([ ! -f package.json ] || npm install --production) && node --check "+entry)
+	default:
+		return nil
+	}
+	id, err := rt.Create(ctx, containerSpec{
+		Image:      imageMapping[file],
+		Cmd:        cmd,
+		WorkingDir: "/app",
+		Network:    networkFull,
+	})
+	if err != nil {
+		return err
+	}
+	defer rt.Remove(context.Background(), id)
+	if err = rt.CopyIn(ctx, id, "/app/", dir); err != nil {
+		return err
+	}
+	returnCode, stderr, err := sandboxExec(ctx, id)
+	if err != nil {
+		return err
+	}
+	if returnCode != 0 {
+		return execErr{
+			cmd:     "sandbox check code",
+			errMsg:  stderr,
+			errCode: int(returnCode),
+		}
+	}
+	if ref != "" {
+		return rt.Commit(ctx, id, ref)
+	}
+	return nil
+}
+
+// sandboxExec 启动沙箱并等待退出, 返回退出码及stderr
+func sandboxExec(ctx context.Context, id string) (int64, string, error) {
+	if err := rt.Start(ctx, id); err != nil {
+		return -1, "", err
+	}
+	stderr := &strings.Builder{}
+	logDone := make(chan struct{})
+	go func() {
+		rt.Logs(ctx, id, ioutil.Discard, stderr)
+		close(logDone)
+	}()
+	returnCode, err := rt.Wait(ctx, id)
+	if err != nil {
+		return returnCode, "", err
+	}
+	<-logDone
+	return returnCode, stderr.String(), nil
+}
+
+// imageRef 程序镜像的名称, 标签为版本号及依赖文件(requirements.txt, package.json)的哈希, 依赖变化时随之变化
+// 不需要镜像(编译型语言)时返回空
+func imageRef(p programInfo) string {
+	var deps string
+	switch p.file {
+	case python2, python3:
+		deps = "requirements.txt"
+	case nodejs:
+		deps = "package.json"
+	default:
+		return ""
+	}
+	buf, _ := ioutil.ReadFile(p.dir + "/" + deps)
+	sum := sha256.Sum256(buf)
+	return fmt.Sprintf("aaf-program-%s:%d-%x", strings.ToLower(string(p.id)), p.revision, sum[:6])
+}
+
+// imageLookup 运行使用的镜像, 不在启动时构建
+// 程序镜像不存在或依赖已变化时请求后台重新构建, 期间使用上一个可用的程序镜像, 没有时返回errImageNotReady
+func imageLookup(p programInfo) (string, error) {
+	ref := imageRef(p)
+	if ref == "" {
+		return imageMapping[p.file], nil
+	}
+	if imageReady(p) {
+		return ref, nil
+	}
+	imageRequest(p)
+	if p.options.Image != "" && rt.ImageExists(context.Background(), p.options.Image) {
+		return p.options.Image, nil
+	}
+	return "", errImageNotReady
+}
+
+func newProcess(ctxRoot context.Context, p programInfo, argv string, dbList []dbInfo, options programOptions, origin frameOrigin) (string, error) {
+	image, err := imageLookup(p)
+	if err != nil {
+		return "", err
+	}
+	runID, err := newID() // 运行ID与容器ID无关, 用于事件、stop及结果查询
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(ctxRoot)
+	var env []string
+	gateway, err := rt.Network(ctx, options.Network)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	if gateway != "" {
+		env = append(env, frameworkAddrEnv+"="+gateway)
+	}
+	sess := sessionIDGen(16)
+	entry := p.entrypoint()
+	cmd := []string{"sh", "-c"}
+	switch p.file {
+	case python2:
+		cmd = append(cmd, fmt.Sprintf("python2 %s %s %s", entry, sess, argv))
+	case python3:
+		cmd = append(cmd, fmt.Sprintf("python3 %s %s %s", entry, sess, argv))
+	case nodejs:
+		cmd = append(cmd, fmt.Sprintf("node %s %s %s", entry, sess, argv))
+	case java:
+		cmd = append(cmd, fmt.Sprintf("java -cp app.jar %s %s %s", javaMainClass(p.dir, entry), sess, argv))
+	case golang, cpp:
+		cmd = append(cmd, fmt.Sprintf("./main %s %s", sess, argv))
+	}
+	containerID, err := rt.Create(ctx, containerSpec{
+		Image:      image,
+		Cmd:        cmd,
+		Env:        env,
+		WorkingDir: "/app",
+		Limits:     options.Limits,
+		Network:    options.Network,
+	})
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	if err = rt.CopyIn(ctx, containerID, "/app/", p.dir); err != nil {
+		rt.Remove(context.Background(), containerID)
+		cancel()
+		return "", err
+	}
+	var proxies []net.Listener
+	if options.Network == networkDatasource {
+		if dbList, proxies, err = dbProxy(runID, gateway, dbList); err != nil {
+			rt.Remove(context.Background(), containerID)
+			cancel()
+			return "", err
+		}
+	}
+	processLock.Lock()
+	containerSessToID[sess] = runID
+	dbListMapping[runID] = dbList
+	proxyMapping[runID] = proxies
+	processMapping[runID] = processInfo{cancel: cancel, immediate: p.immediate, program: p.id, container: containerID, origin: origin}
+	processLock.Unlock()
+	resultInit(runID, containerID, p.id, p.revision)
+	if p.immediate == false {
+		dataStore(runID, "", "", nil)
+	}
+	if err = rt.Start(ctx, containerID); err != nil {
+		rt.Remove(context.Background(), containerID)
+		cancel()
+		processLock.Lock()
+		delete(containerSessToID, sess)
+		delete(processMapping, runID)
+		processLock.Unlock()
+		outputs, _ := dataRead(runID)
+		for i := range outputs {
+			outputs[i].body.Close()
+		}
+		resultRemove(runID)
+		dbInfoRemove(runID)
+		return "", err
+	}
+	historyStart(runID, argv)
+	l := logCapture(ctx, runID, containerID, p.id)
+	go containerListenAndServe(ctx, runID, containerID, sess, p, origin, l, options.Timeout.Duration)
+	return runID, nil
+}
+
+func containerListenAndServe(ctx context.Context, runID, containerID string, sess sessionID, p programInfo, origin frameOrigin, l *runLog, timeout time.Duration) {
+	var timedOut int32
+	if timeout > 0 { // SIGTERM, conf.Run.StopGrace后SIGKILL
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			logger.Printf("Container: %s timeout.\n", containerID)
+			if err := rt.Kill(context.Background(), containerID, conf.Run.StopGrace.Duration); err != nil {
+				logger.Printf("Container: %s stop: %v.\n", containerID, err)
+			}
+		})
+		defer timer.Stop()
+	}
+	usage := &usageSampler{}
+	sampling := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(usageInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sampling:
+				return
+			case <-ticker.C:
+				if stats, err := rt.Stats(context.Background(), containerID); err == nil {
+					usage.sample(stats)
+				}
+			}
+		}
+	}()
+	returnCode, err := rt.Wait(ctx, containerID)
+	close(sampling)
+	logger.Printf("Container: %s (run %s) return %d.\n", containerID, runID, returnCode)
+	if err != nil {
+		logger.Printf("Exit with error: %s.\n", err.Error())
+	}
+	stderr := l.wait(5 * time.Second)
+	outputs, failed := dataRead(runID)
+	ev := runEvent{Type: "stoped", Program: p.id, Run: runID, Code: returnCode}
+	if failed {
+		ev.Reason = reasonResultTooLarge
+	} else if atomic.LoadInt32(&timedOut) == 1 {
+		ev.Reason = reasonTimeout
+	}
+	if stats, err := rt.Stats(context.Background(), containerID); err == nil {
+		usage.sample(stats)
+		if ev.Reason == "" && stats.OOMKilled {
+			ev.Reason = reasonOOM
+		}
+	}
+	if returnCode != 0 {
+		ev.Stderr = stderr
+	}
+
+	mqLock.Lock() // 互斥锁上锁
+	eventSend(ev, origin)
+	for _, out := range outputs { // 从缓存(内存或磁盘)流式写入消息队列
+		eventSend(runEvent{
+			Type:        "data",
+			Program:     p.id,
+			Run:         runID,
+			Name:        out.name,
+			ContentType: out.contentType,
+			Size:        out.size,
+			body:        out.body,
+		}, origin)
+		out.body.Close()
+	}
+	resultDone(runID, returnCode, ev.Reason, ev.Stderr)
+	mqLock.Unlock() // 互斥锁解锁
+	historyDone(runID, usage.get())
+	rt.Remove(context.Background(), containerID)
+	dbInfoRemove(runID)
+	processCancel(runID)
+	processLock.Lock()
+	delete(containerSessToID, sess)
+	processLock.Unlock()
+}
+
+// dbProxy 在网关上为每个数据源监听一个端口并转发, 返回地址替换后的dbList
+// 仅接受来自该容器(已通过:2076认证)的连接
+func dbProxy(runID, gateway string, dbList []dbInfo) ([]dbInfo, []net.Listener, error) {
+	out := make([]dbInfo, len(dbList))
+	proxies := make([]net.Listener, 0, len(dbList))
+	for i, db := range dbList {
+		target, replace, err := dbAddrParse(db)
+		if err != nil {
+			proxyClose(proxies)
+			return nil, nil, err
+		}
+		ln, err := proxyListen(gateway)
+		if err != nil {
+			proxyClose(proxies)
+			return nil, nil, err
+		}
+		proxies = append(proxies, ln)
+		go proxyServe(ln, runID, target)
+		out[i] = db
+		out[i].Addr = replace(ln.Addr().String())
+	}
+	return out, proxies, nil
+}
+
+// proxyListen 在网关上监听conf.Run.ProxyPortMin - ProxyPortMax中的一个空闲端口, 隔离网络的防火墙仅放行该范围
+func proxyListen(gateway string) (net.Listener, error) {
+	min, max := conf.Run.ProxyPortMin, conf.Run.ProxyPortMax
+	n := max - min + 1
+	start := int(atomic.AddUint32(&proxyNext, 1))
+	var err error
+	for i := 0; i < n; i++ {
+		ln, e := net.Listen("tcp", net.JoinHostPort(gateway, strconv.Itoa(min+(start+i)%n)))
+		if e == nil {
+			return ln, nil
+		}
+		err = e
+	}
+	return nil, err
+}
+
+// dbAddrParse 解析数据源地址("host:port"或"http://host:port"), 未指定端口时使用默认端口
+func dbAddrParse(db dbInfo) (target string, replace func(string) string, err error) {
+	if strings.Contains(db.Addr, "://") {
+		u, err := url.Parse(db.Addr)
+		if err != nil {
+			return "", nil, err
+		}
+		target = u.Host
+		replace = func(addr string) string {
+			v := *u
+			v.Host = addr
+			return v.String()
+		}
+	} else {
+		target = db.Addr
+		replace = func(addr string) string { return addr }
+	}
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		port, ok := dbPorts[db.Type]
+		if !ok {
+			return "", nil, err
+		}
+		target = net.JoinHostPort(target, port)
+	}
+	return target, replace, nil
+}
+
+func proxyServe(ln net.Listener, runID, target string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if !containerAddr(runID, conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := net.DialTimeout("tcp", target, 10*time.Second)
+			if err != nil {
+				logger.Printf("Run: %s proxy: %v.\n", runID, err)
+				return
+			}
+			defer remote.Close()
+			go func() {
+				io.Copy(remote, conn)
+				remote.Close()
+			}()
+			io.Copy(conn, remote)
+		}()
+	}
+}
+
+// containerAddr 判断addr的IP是否为运行runID的容器与框架通信时使用的IP
+func containerAddr(runID, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	processLock.RLock()
+	defer processLock.RUnlock()
+	for k, v := range addressToRunID {
+		if v != runID {
+			continue
+		}
+		if h, _, err := net.SplitHostPort(k); err == nil && h == host {
+			return true
+		}
+	}
+	return false
+}
+
+func proxyClose(proxies []net.Listener) {
+	for _, ln := range proxies {
+		ln.Close()
+	}
+}
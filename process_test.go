@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processTestSetup 初始化运行记录及消息队列, 上传一个python3程序, 返回其ID
+// 上传完成后设置Hold, 之后启动的容器保持运行直到exit
+func processTestSetup(t *testing.T) (*fakeRuntime, programIndex) {
+	t.Helper()
+	f := testSetup(t)
+	if err := historyOpen(storePath + "/.runs"); err != nil {
+		t.Fatal(err)
+	}
+	mqReopen(t, storePath+"/.queue")
+	src := "print('hello')\n"
+	p, err := programCreate(programInfo{file: python3}, strings.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Hold = true
+	t.Cleanup(func() { // 停止所有运行并等待其结束, 避免影响之后的测试
+		ctxRootCancel()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			processLock.RLock()
+			n := len(containerSessToID)
+			processLock.RUnlock()
+			if n == 0 {
+				return
+			}
+		}
+		t.Error("runs not stopped")
+	})
+	return f, p.id
+}
+
+// processTestStoped 等待该运行的stoped事件
+func processTestStoped(t *testing.T, sub *eventSubscriber, runID string) runEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-sub.ch:
+			if ev.Type == "stoped" && ev.Run == runID {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("run %s: no stoped event", runID)
+		}
+	}
+}
+
+// processTestHistory 等待运行记录变为status
+func processTestHistory(t *testing.T, runID, status string) runRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, ok := historyGet(runID)
+		if ok && v.Status == status {
+			return v
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("run %s: history %+v, want status %s", runID, v, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runStart -> containerListenAndServe -> stoped, 运行记录从running变为stoped
+func TestRunStoped(t *testing.T) {
+	f, id := processTestSetup(t)
+	sub := eventSubscribe(eventFilter{program: id})
+	defer eventUnsubscribe(sub)
+	runID, err := runStart(id, 0, "--n 1", nil, programOptions{}, frameOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := processTestHistory(t, runID, "running")
+	if v.Argv != "--n 1" || v.Program != id || v.Revision != 1 {
+		t.Fatalf("history %+v", v)
+	}
+	if v.Container == "" || v.Container == runID {
+		t.Fatalf("container ID %q, run ID %q", v.Container, runID)
+	}
+	f.exit(v.Container, 3, "", "Traceback\nValueError: boom\n", false)
+	ev := processTestStoped(t, sub, runID)
+	if ev.Code != 3 || ev.Reason != "" || !strings.Contains(ev.Stderr, "boom") {
+		t.Fatalf("stoped %+v", ev)
+	}
+	v = processTestHistory(t, runID, "stoped")
+	if v.Code != 3 || v.End == nil {
+		t.Fatalf("history %+v", v)
+	}
+	if _, err = f.get(v.Container); err == nil {
+		t.Fatal("container not removed")
+	}
+	if page := programList(catalogQuery{limit: 1}); page.Programs[0].Runs != 1 {
+		t.Fatalf("program runs %d", page.Programs[0].Runs)
+	}
+}
+
+// 超时及内存超限时stoped事件附带原因
+func TestRunStopedReason(t *testing.T) {
+	f, id := processTestSetup(t)
+	sub := eventSubscribe(eventFilter{program: id})
+	defer eventUnsubscribe(sub)
+	runID, err := runStart(id, 0, "", nil, programOptions{Timeout: duration{50 * time.Millisecond}}, frameOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := processTestStoped(t, sub, runID); ev.Reason != reasonTimeout {
+		t.Fatalf("stoped %+v, want reason %s", ev, reasonTimeout)
+	}
+	processTestHistory(t, runID, "stoped")
+	if runID, err = runStart(id, 0, "", nil, programOptions{}, frameOrigin{}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := resultGet(runID)
+	f.exit(r.Container, 137, "", "", true)
+	if ev := processTestStoped(t, sub, runID); ev.Reason != reasonOOM || ev.Code != 137 {
+		t.Fatalf("stoped %+v, want reason %s", ev, reasonOOM)
+	}
+}
+
+// 框架在运行结束前退出, 重新加载后运行记录标记为lost
+func TestRunHistoryLost(t *testing.T) {
+	_, id := processTestSetup(t)
+	runID, err := runStart(id, 0, "", nil, programOptions{}, frameOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processTestHistory(t, runID, "running")
+	historyLock.Lock()
+	historyMapping = make(map[string]*runRecord)
+	historyLock.Unlock()
+	if err = historyOpen(storePath + "/.runs"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := historyGet(runID); !ok || v.Status != statusLost {
+		t.Fatalf("history %+v, want status %s", v, statusLost)
+	}
+}
+
+// 数据源转发只使用配置的端口范围, 端口用尽时失败
+func TestProxyListenRange(t *testing.T) {
+	testSetup(t)
+	min, max := conf.Run.ProxyPortMin, conf.Run.ProxyPortMax
+	defer func() { conf.Run.ProxyPortMin, conf.Run.ProxyPortMax = min, max }()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	conf.Run.ProxyPortMin, conf.Run.ProxyPortMax = port, port+1
+	var proxies []net.Listener
+	defer func() { proxyClose(proxies) }()
+	for i := 0; i < 2; i++ {
+		ln, err := proxyListen("127.0.0.1")
+		if err != nil {
+			t.Skipf("port %d in use: %v", port+i, err)
+		}
+		proxies = append(proxies, ln)
+		if p := ln.Addr().(*net.TCPAddr).Port; p < port || p > port+1 {
+			t.Fatalf("port %d out of range %d-%d", p, port, port+1)
+		}
+	}
+	if ln, err := proxyListen("127.0.0.1"); err == nil {
+		ln.Close()
+		t.Fatal("listened beyond the range")
+	}
+}
+
+// 日志的获取及保留以运行记录为准, 内存中的运行结果删除后(如重启)仍可获取
+func TestLogRetention(t *testing.T) {
+	f, id := processTestSetup(t)
+	sub := eventSubscribe(eventFilter{program: id})
+	defer eventUnsubscribe(sub)
+	runID, err := runStart(id, 0, "", nil, programOptions{}, frameOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := resultGet(runID)
+	f.exit(r.Container, 0, "hello\n", "", false)
+	processTestStoped(t, sub, runID)
+	processTestHistory(t, runID, "stoped")
+	resultRemove(runID)
+	if buf, err := logGet(runID, logStdout); err != nil || string(buf) != "hello\n" {
+		t.Fatalf("stdout %q, %v", buf, err)
+	}
+	orphan := logPath("ORPHAN", logStdout)
+	ioutil.WriteFile(orphan, nil, 0644)
+	os.MkdirAll(storePath+"/.spill", 0755)
+	ioutil.WriteFile(storePath+"/.spill/R-1", nil, 0644)
+	logSweep()
+	spillSweep()
+	if pathStat(orphan) != notExist || pathStat(storePath+"/.spill/R-1") != notExist {
+		t.Fatal("orphaned files not removed")
+	}
+	if pathStat(logPath(runID, logStdout)) != file {
+		t.Fatal("log of a recorded run removed")
+	}
+	retention := conf.History.Retention
+	conf.History.Retention = duration{time.Nanosecond}
+	defer func() { conf.History.Retention = retention }()
+	historyLock.Lock()
+	err = historyCompact(historyFile.Name())
+	historyLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = logGet(runID, logStdout); err != errNoID {
+		t.Fatalf("logGet after retention: %v", err)
+	}
+	if pathStat(logPath(runID, logStdout)) != notExist {
+		t.Fatal("expired log not removed")
+	}
+}
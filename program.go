@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 以下为程序及运行的基础操作, 由TLS命令与REST接口共用
+
+// programTypeParse 解析上传类型(低7位: 文件类型, 最高位: 是否立即推送结果)
+func programTypeParse(t byte) (s programInfo, err error) {
+	switch t & 0x7F {
+	case 1:
+		s.file = python2
+	case 2:
+		s.file = python3
+	case 3:
+		s.file = golang
+	case 4:
+		s.file = nodejs
+	case 5:
+		s.file = java
+	case 6:
+		s.file = cpp
+	default:
+		return s, errTypeErr
+	}
+	s.immediate = (t & 0x80) == 0x80
+	return s, nil
+}
+
+var fileTypeNames = map[fileType]string{
+	python2: "python2",
+	python3: "python3",
+	golang:  "golang",
+	nodejs:  "nodejs",
+	java:    "java",
+	cpp:     "cpp",
+}
+
+func (t fileType) String() string {
+	return fileTypeNames[t]
+}
+
+// fileTypeParse 由语言名称(见fileTypeNames)获取文件类型
+func fileTypeParse(name string) (fileType, bool) {
+	for k, v := range fileTypeNames {
+		if v == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+func sourceName(file fileType) string {
+	switch file {
+	case golang:
+		return "main.go"
+	case nodejs:
+		return "main.js"
+	case java:
+		return "Main.java"
+	case cpp:
+		return "main.cpp"
+	default:
+		return "main.py"
+	}
+}
+
+// programOptions 程序或运行的选项, 上传时指定的程序选项保存在options.json
+type programOptions struct {
+	Limits  resourceLimits `json:"limits"`
+	Timeout duration       `json:"timeout"`           // 运行时间上限, 0表示不限制
+	Network string         `json:"network,omitempty"` // 网络策略, 仅可按程序指定
+	Image   string         `json:"image,omitempty"`   // 构建的程序镜像(包含依赖), 非用户选项
+	// 以下由上传选项指定, 见uploadParse
+	Archive    string `json:"archive,omitempty"`    // 上传的归档格式, 为空表示单个源文件
+	Entrypoint string `json:"entrypoint,omitempty"` // 入口源文件, 为空时为sourceName
+}
+
+// optionsParse 解析上传或启动命令的选项, 见limitsParse; timeout: 30s, 10m ...; network: none, framework, datasource, full
+func optionsParse(opt url.Values) (o programOptions, err error) {
+	if o.Limits, err = limitsParse(opt); err != nil {
+		return o, err
+	}
+	if v := opt.Get("timeout"); v != "" {
+		if o.Timeout.Duration, err = time.ParseDuration(v); err == nil && o.Timeout.Duration < 0 {
+			err = errTimeoutErr
+		}
+	}
+	if err == nil {
+		o.Network = opt.Get("network")
+		err = networkCheck(o.Network, true)
+	}
+	return o, err
+}
+
+// merge 以o中非空的项覆盖p
+func (p programOptions) merge(o programOptions) programOptions {
+	p.Limits = p.Limits.merge(o.Limits)
+	if o.Timeout.Duration != 0 {
+		p.Timeout = o.Timeout
+	}
+	if o.Network != "" {
+		p.Network = o.Network
+	}
+	return p
+}
+
+// entrypoint 入口源文件相对于程序目录的路径
+func (p programInfo) entrypoint() string {
+	if p.options.Entrypoint != "" {
+		return p.options.Entrypoint
+	}
+	return sourceName(p.file)
+}
+
+// sdkName 与程序一同保存的SDK(source目录下)
+func sdkName(file fileType) string {
+	switch file {
+	case python3:
+		return "driver.py"
+	case nodejs:
+		return "driver.js"
+	case java:
+		return "Driver.java"
+	case cpp:
+		return "driver.hpp"
+	}
+	return ""
+}
+
+// programCreate 创建程序及其第一个版本, 成功后返回该版本
+func programCreate(s programInfo, src io.Reader, length int64) (programInfo, error) {
+	if length > conf.Upload.MaxSize {
+		io.CopyN(ioutil.Discard, src, length)
+		return programInfo{}, errUploadSize
+	}
+	id, err := newID()
+	if err != nil {
+		io.CopyN(ioutil.Discard, src, length)
+		return programInfo{}, err
+	}
+	s.created = time.Now()
+	s.id = programIndex(id)
+	s.revision = 1
+	if err := programStore(&s, src, length); err != nil {
+		os.Remove(storePath + "/" + string(s.id))
+		return programInfo{}, err
+	}
+	e := &programEntry{current: 1, latest: 1, revisions: make(map[int]programInfo)}
+	e.ctx, e.cancel = context.WithCancel(ctxRoot)
+	s.ctx, s.cancel = e.ctx, e.cancel
+	e.revisions[1] = s
+	if err := e.store(s.id); err != nil {
+		e.cancel()
+		revisionRemove(s)
+		os.RemoveAll(storePath + "/" + string(s.id))
+		return programInfo{}, err
+	}
+	programLock.Lock()
+	programMapping[s.id] = e
+	programLock.Unlock()
+	return s, nil
+}
+
+// programStore 保存并编译程序的一个版本, 失败时删除该版本
+// src保存于对象存储, s.options.Archive不为空时src为归档, 解压到版本目录, 否则链接为版本目录中的源文件
+func programStore(s *programInfo, src io.Reader, length int64) error {
+	path := revisionDir(s.id, s.revision)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		io.CopyN(ioutil.Discard, src, length)
+		return err
+	}
+	s.dir = path
+	fail := func(err error) error {
+		revisionRemove(*s)
+		return err
+	}
+	if s.sourceHash, err = objectPut(src, length); err != nil {
+		return fail(err)
+	}
+	if s.options.Archive != "" {
+		err = unpack(s.options.Archive, objectPath(s.sourceHash), path)
+	} else {
+		err = objectLink(s.sourceHash, path+"/"+sourceName(s.file))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	entry := filepath.FromSlash(s.entrypoint())
+	if pathStat(filepath.Join(path, entry)) != file {
+		return fail(errEntrypointErr)
+	}
+	if err = sdkCopy(*s); err != nil {
+		return fail(err)
+	}
+	if err = builder(s); err != nil {
+		return fail(err)
+	}
+	if err = s.cfgStore(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// sdkCopy 将SDK复制到入口文件所在的目录
+// Java的Driver需与入口类位于同一个包, 入口文件有package声明时在Driver.java开头添加相同的声明
+func sdkCopy(s programInfo) error {
+	sdk := sdkName(s.file)
+	if sdk == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile("source/" + sdk)
+	if err != nil {
+		return err
+	}
+	entry := filepath.Join(s.dir, filepath.FromSlash(s.entrypoint()))
+	if s.file == java {
+		src, _ := ioutil.ReadFile(entry)
+		if m := javaPackageRegexp.FindSubmatch(src); m != nil {
+			buf = append([]byte("package "+string(m[1])+";\n\n"), buf...)
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(filepath.Dir(entry), sdk), buf, 0644)
+}
+
+// programGet 获取程序的当前版本
+func programGet(id programIndex) (programInfo, error) {
+	return revisionGet(id, 0)
+}
+
+func programRemove(id programIndex) error {
+	programLock.Lock()
+	e, ok := programMapping[id]
+	delete(programMapping, id)
+	programLock.Unlock()
+	if !ok {
+		return errNoID
+	}
+	e.cancel()
+	for _, v := range e.revisions {
+		revisionRemove(v)
+	}
+	os.RemoveAll(storePath + "/" + string(id))
+	return nil
+}
+
+// programSource 读取程序版本rev(0为当前版本)目录中的文件name, 为空时为入口文件
+func programSource(id programIndex, rev int, name string) ([]byte, error) {
+	p, err := revisionGet(id, rev)
+	if err != nil {
+		return nil, errNoMapping
+	}
+	if name == "" {
+		name = p.entrypoint()
+	}
+	if name, err = archiveName(name); err != nil {
+		return nil, err
+	}
+	name = filepath.Join(p.dir, filepath.FromSlash(name))
+	if pathStat(name) != file {
+		return nil, errNoMapping
+	}
+	return ioutil.ReadFile(name)
+}
+
+// programArchive 读取程序版本rev(0为当前版本)上传的归档, 返回归档格式
+func programArchive(id programIndex, rev int) ([]byte, string, error) {
+	p, err := revisionGet(id, rev)
+	if err != nil || p.options.Archive == "" {
+		return nil, "", errNoMapping
+	}
+	buf, err := ioutil.ReadFile(objectPath(p.sourceHash))
+	return buf, p.options.Archive, err
+}
+
+// runStart 启动程序的版本rev(0为当前版本), 返回runID
+// options为该运行指定的选项, 覆盖程序选项及默认配置
+func runStart(id programIndex, rev int, argv string, dbList []dbInfo, options programOptions, origin frameOrigin) (string, error) {
+	p, err := revisionGet(id, rev)
+	if err != nil {
+		return "", err
+	}
+	if options.Network != "" {
+		return "", errNetworkRun
+	}
+	if err = p.sourceVerify(); err != nil {
+		logger.Printf("Program: %s revision %d: %v.\n", p.id, p.revision, err)
+		return "", err
+	}
+	options = programOptions{Limits: conf.Limits, Timeout: conf.Run.Timeout, Network: conf.Run.Network}.merge(p.options).merge(options)
+	runID, err := newProcess(p.ctx, p, argv, dbList, options, origin)
+	if err == nil {
+		programRan(p.id)
+	}
+	return runID, err
+}
+
+func runStop(runID string) error {
+	processLock.Lock()
+	v, ok := processMapping[runID]
+	delete(processMapping, runID)
+	processLock.Unlock()
+	if !ok {
+		return errNoID
+	}
+	v.cancel()
+	return nil
+}
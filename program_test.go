@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// 入口类位于命名的包中时, 复制的Driver.java使用相同的包
+func TestSdkCopyJavaPackage(t *testing.T) {
+	testSetup(t)
+	for _, c := range []struct{ src, want string }{
+		{"package com.example.app;\n\npublic class Main {}\n", "package com.example.app;\n\nimport "},
+		{"public class Main {}\n", "import "},
+	} {
+		p, err := programCreate(programInfo{file: java}, strings.NewReader(c.src), int64(len(c.src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(p.dir + "/Driver.java")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(buf), c.want) {
+			t.Fatalf("Driver.java starts with %q, want %q", buf[:40], c.want)
+		}
+	}
+}
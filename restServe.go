@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// REST接口, 与TLS命令共用同一组基础操作
+// GET    /programs?language=python3&offset=0&limit=100  程序列表
+// POST   /programs?type=python3&immediate=true  body: 源代码或归档(archive=tgz|zip&entrypoint=...), 可附带程序选项(memory, cpus, pids, timeout...)
+// DELETE /programs/{id}
+// GET    /programs/{id}/source?path=...          入口文件或指定的文件, archive=true时为上传的归档
+// GET    /programs/{id}/revisions                版本列表
+// POST   /programs/{id}/revisions?type=...       body同上传, 创建新版本, promote=false时不设为当前版本
+// POST   /programs/{id}/promote?revision=N       设为当前版本
+// POST   /programs/{id}/rollback[?revision=N]    回退当前版本
+// source、runs可通过revision=N指定版本, 默认为当前版本
+// POST   /programs/{id}/runs                   body: {"argv": "", "databases": [dbInfo...]}, 可附带运行选项
+// GET    /runs?program={id}&status=stoped&since=RFC3339&offset=0&limit=100  运行记录
+// GET    /runs/{id}                             运行中或1小时内结束的运行返回运行结果, 之后返回运行记录
+// GET    /runs/{id}/data?name={output}           输出数据, 从消息队列中读取, 未指定name时为默认输出
+// GET    /runs/{id}/logs?stream=stderr           容器的stdout(默认)或stderr
+// DELETE /runs/{id}
+// GET    /events?program={id}&run={id}           Server-Sent Events
+// 认证: "Authorization: Bearer " + login.key, 或查询参数 "token"(用于浏览器EventSource)
+
+type restRunRequest struct {
+	Argv      string   `json:"argv"`
+	Databases []dbInfo `json:"databases"`
+}
+
+type restError struct {
+	Error string `json:"error"`
+}
+
+var restTypeMapping = map[string]byte{
+	"python2": 1,
+	"python3": 2,
+	"golang":  3,
+	"nodejs":  4,
+	"java":    5,
+	"cpp":     6,
+}
+
+var restArchiveType = map[string]string{
+	archiveTgz: "application/gzip",
+	archiveZip: "application/zip",
+}
+
+// restRunBodyMax 启动运行的请求体(argv及数据源)的上限
+const restRunBodyMax = 1 << 20
+
+func restHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/programs", restAuth(restPrograms))
+	mux.HandleFunc("/programs/", restAuth(restProgram))
+	mux.HandleFunc("/runs", restAuth(restRuns))
+	mux.HandleFunc("/runs/", restAuth(restRun))
+	mux.HandleFunc("/events", restAuth(restEvents))
+	return mux
+}
+
+func restListenAndServe(ctx context.Context, laddr string, cfg *tls.Config) {
+	srv := &http.Server{
+		Addr:      laddr,
+		Handler:   restHandler(),
+		TLSConfig: cfg,
+	}
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		srv.Shutdown(ctx)
+		cancel()
+	}()
+	go func() {
+		var err error
+		if cfg != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			logger.Println(err)
+		}
+	}()
+}
+
+func restAuth(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 || networkIsolated(r.RemoteAddr) {
+			restWriteError(w, http.StatusUnauthorized, errAuthFailed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// restPrograms GET, POST /programs
+func restPrograms(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		q, err := catalogParse(r.URL.Query())
+		if err != nil {
+			restWriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		restWriteJSON(w, http.StatusOK, programList(q))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s, ok := restUploadParse(w, r)
+	if !ok {
+		return
+	}
+	s, err := programCreate(s, r.Body, r.ContentLength)
+	if err != nil {
+		restUploadError(w, err)
+		return
+	}
+	restWriteJSON(w, http.StatusCreated, map[string]interface{}{"id": s.id, "revision": s.revision, "sourceHash": s.sourceHash})
+}
+
+// restUploadParse 解析上传的类型及选项, 失败时写入错误
+func restUploadParse(w http.ResponseWriter, r *http.Request) (programInfo, bool) {
+	t, ok := restTypeMapping[r.URL.Query().Get("type")]
+	if !ok {
+		restWriteError(w, http.StatusBadRequest, errTypeErr)
+		return programInfo{}, false
+	}
+	if immediate, _ := strconv.ParseBool(r.URL.Query().Get("immediate")); immediate {
+		t |= 0x80
+	}
+	s, err := programTypeParse(t)
+	if err == nil {
+		err = uploadParse(&s, r.URL.Query())
+	}
+	if err != nil {
+		restWriteError(w, http.StatusBadRequest, err)
+		return s, false
+	}
+	if r.ContentLength < 0 {
+		w.WriteHeader(http.StatusLengthRequired)
+		return s, false
+	}
+	if r.ContentLength > conf.Upload.MaxSize {
+		restWriteError(w, http.StatusRequestEntityTooLarge, errUploadSize)
+		return s, false
+	}
+	return s, true
+}
+
+func restUploadError(w http.ResponseWriter, err error) {
+	if _, ok := err.(execErr); ok {
+		restWriteError(w, http.StatusUnprocessableEntity, err)
+	} else if err == errArchiveErr || err == errEntrypointErr || err == errUploadSize {
+		restWriteError(w, http.StatusBadRequest, err)
+	} else if err == errNoID {
+		restWriteError(w, http.StatusNotFound, err)
+	} else {
+		restWriteError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// restRevisionError 版本操作的错误
+func restRevisionError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNoID, errNoRevision:
+		restWriteError(w, http.StatusNotFound, err)
+	case errRevisionErr:
+		restWriteError(w, http.StatusBadRequest, err)
+	case errNoRollback:
+		restWriteError(w, http.StatusConflict, err)
+	default:
+		restWriteError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// restRunError 启动运行的错误, 选项错误为400, 程序或版本不存在为404, 程序镜像正在构建为503
+func restRunError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNoID, errNoRevision:
+		restWriteError(w, http.StatusNotFound, err)
+	case errNetworkRun, errNetworkErr, errNetworkSupport, errLimitErr, errTimeoutErr, errRevisionErr:
+		restWriteError(w, http.StatusBadRequest, err)
+	case errImageNotReady:
+		restWriteError(w, http.StatusServiceUnavailable, err)
+	default:
+		restWriteError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// restProgram /programs/{id}, /programs/{id}/source, /programs/{id}/runs, /programs/{id}/revisions, /programs/{id}/promote, /programs/{id}/rollback
+func restProgram(w http.ResponseWriter, r *http.Request) {
+	l := strings.Split(strings.TrimPrefix(r.URL.Path, "/programs/"), "/")
+	id := programIndex(l[0])
+	rev, err := revisionParse(r.URL.Query().Get("revision"))
+	if err != nil {
+		restWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case len(l) == 1 && r.Method == http.MethodDelete:
+		if err := programRemove(id); err != nil {
+			restWriteError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(l) == 2 && l[1] == "source" && r.Method == http.MethodGet:
+		if archive, _ := strconv.ParseBool(r.URL.Query().Get("archive")); archive {
+			buf, format, err := programArchive(id, rev)
+			if err != nil {
+				restWriteError(w, http.StatusNotFound, err)
+				return
+			}
+			w.Header().Set("Content-Type", restArchiveType[format])
+			w.Write(buf)
+			return
+		}
+		buf, err := programSource(id, rev, r.URL.Query().Get("path"))
+		if err != nil {
+			restWriteError(w, http.StatusNotFound, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf)
+	case len(l) == 2 && l[1] == "runs" && r.Method == http.MethodPost:
+		req := restRunRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, restRunBodyMax)).Decode(&req); err != nil {
+			restWriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		options, err := optionsParse(r.URL.Query())
+		if err != nil {
+			restWriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, err := revisionGet(id, rev); err != nil {
+			restWriteError(w, http.StatusNotFound, err)
+			return
+		}
+		runID, err := runStart(id, rev, req.Argv, req.Databases, options, frameOrigin{})
+		if err != nil {
+			restRunError(w, err)
+			return
+		}
+		restWriteJSON(w, http.StatusCreated, map[string]string{"id": runID})
+	case len(l) == 2 && l[1] == "revisions" && r.Method == http.MethodGet:
+		revisions, err := revisionList(id)
+		if err != nil {
+			restRevisionError(w, err)
+			return
+		}
+		restWriteJSON(w, http.StatusOK, revisions)
+	case len(l) == 2 && l[1] == "revisions" && r.Method == http.MethodPost:
+		promote, err := promoteParse(r.URL.Query().Get("promote"))
+		if err != nil {
+			restWriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		s, ok := restUploadParse(w, r)
+		if !ok {
+			return
+		}
+		s, err = revisionCreate(id, s, r.Body, r.ContentLength, promote)
+		if err != nil {
+			restUploadError(w, err)
+			return
+		}
+		restWriteJSON(w, http.StatusCreated, map[string]interface{}{"id": id, "revision": s.revision, "sourceHash": s.sourceHash})
+	case len(l) == 2 && l[1] == "promote" && r.Method == http.MethodPost:
+		if rev == 0 {
+			restRevisionError(w, errRevisionErr)
+			return
+		}
+		if err := programPromote(id, rev); err != nil {
+			restRevisionError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(l) == 2 && l[1] == "rollback" && r.Method == http.MethodPost:
+		rev, err := programRollback(id, rev)
+		if err != nil {
+			restRevisionError(w, err)
+			return
+		}
+		restWriteJSON(w, http.StatusOK, map[string]int{"revision": rev})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// restRun GET/DELETE /runs/{id}, GET /runs/{id}/data, GET /runs/{id}/logs
+func restRun(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/runs/")
+	if strings.HasSuffix(id, "/data") && r.Method == http.MethodGet {
+		restRunData(w, strings.TrimSuffix(id, "/data"), r.URL.Query().Get("name"))
+		return
+	}
+	if strings.HasSuffix(id, "/logs") && r.Method == http.MethodGet {
+		stream := r.URL.Query().Get("stream")
+		if stream == "" {
+			stream = logStdout
+		}
+		buf, err := logGet(strings.TrimSuffix(id, "/logs"), stream)
+		if err != nil {
+			restWriteError(w, http.StatusNotFound, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if v, ok := resultGet(id); ok {
+			restWriteJSON(w, http.StatusOK, v)
+			return
+		}
+		v, ok := historyGet(id)
+		if !ok {
+			restWriteError(w, http.StatusNotFound, errNoID)
+			return
+		}
+		restWriteJSON(w, http.StatusOK, v)
+	case http.MethodDelete:
+		if err := runStop(id); err != nil {
+			restWriteError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// restRuns GET /runs, 运行记录
+func restRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := historyParse(r.URL.Query())
+	if err != nil {
+		restWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	restWriteJSON(w, http.StatusOK, historyList(q))
+}
+
+// restRunData 输出该运行名称为name的输出数据
+func restRunData(w http.ResponseWriter, id, name string) {
+	v, ok := resultGet(id)
+	if !ok {
+		restWriteError(w, http.StatusNotFound, errNoID)
+		return
+	}
+	var out *runOutput
+	for i := range v.Outputs {
+		if v.Outputs[i].Name == name {
+			out = &v.Outputs[i]
+		}
+	}
+	if out == nil {
+		restWriteError(w, http.StatusNotFound, errNoMapping)
+		return
+	}
+	bodies := make([]io.Reader, 0, len(out.dataSeq))
+	defer func() {
+		for _, body := range bodies {
+			body.(io.Closer).Close()
+		}
+	}()
+	for _, seq := range out.dataSeq {
+		body, _, err := mqData(seq)
+		if err != nil {
+			restWriteError(w, http.StatusGone, err)
+			return
+		}
+		bodies = append(bodies, body)
+	}
+	if out.ContentType != "" {
+		w.Header().Set("Content-Type", out.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(out.Size, 10))
+	io.Copy(w, io.MultiReader(bodies...))
+}
+
+// restEvents GET /events, 以SSE推送运行事件, 可按程序或容器过滤
+func restEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var last uint64 // 已发送的最后一条消息的序号
+	if v := r.Header.Get("Last-Event-ID"); v != "" || r.URL.Query().Get("lastEventId") != "" {
+		if v == "" {
+			v = r.URL.Query().Get("lastEventId")
+		}
+		var err error
+		if last, err = strconv.ParseUint(v, 10, 64); err != nil {
+			restWriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	filter := eventFilter{
+		program: programIndex(r.URL.Query().Get("program")),
+		run:     runFilter(r.URL.Query()),
+	}
+	sub := eventSubscribe(filter) // 先订阅再重放, 重放之后的消息均会发布给sub
+	defer eventUnsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if last != 0 { // 从消息队列重放last之后的消息
+		mqMutex.Lock()
+		to := mqLastSeq
+		mqMutex.Unlock()
+		var err error
+		mqEvents(last+1, to, func(ev runEvent) bool {
+			if filter.match(ev) {
+				err = sseWrite(w, ev)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return
+		}
+		last = to
+	}
+	flusher.Flush()
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C: // keep alive
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if ev.Seq != 0 && ev.Seq <= last { // 已重放
+				continue
+			}
+			if err := sseWrite(w, ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// sseWrite 写入一个SSE事件, 消息队列中的事件以序号为id, 容器输出(stdout, stderr)没有id
+func sseWrite(w io.Writer, ev runEvent) error {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		logger.Println(err)
+		return nil
+	}
+	if ev.Seq != 0 {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, buf)
+	} else {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, buf)
+	}
+	return err
+}
+
+func restWriteJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func restWriteError(w http.ResponseWriter, code int, err error) {
+	restWriteJSON(w, code, restError{Error: err.Error()})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// restTestKey 测试时的login.key
+const restTestKey = "secret"
+
+// restTestSetup 在processTestSetup的基础上设置login.key
+func restTestSetup(t *testing.T) (*fakeRuntime, programIndex) {
+	t.Helper()
+	f, id := processTestSetup(t)
+	saved := key
+	key = restTestKey
+	t.Cleanup(func() { key = saved })
+	return f, id
+}
+
+// restTestDo 以login.key认证发送请求
+func restTestDo(method, target string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("Authorization", "Bearer "+restTestKey)
+	w := httptest.NewRecorder()
+	restHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestRestAuth(t *testing.T) {
+	restTestSetup(t)
+	for _, c := range []struct {
+		name, header, target string
+		want                 int
+	}{
+		{"none", "", "/runs", http.StatusUnauthorized},
+		{"wrong key", "Bearer wrong", "/runs", http.StatusUnauthorized},
+		{"wrong query", "", "/runs?token=wrong", http.StatusUnauthorized},
+		{"header", "Bearer " + restTestKey, "/runs", http.StatusOK},
+		{"query", "", "/runs?token=" + restTestKey, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.target, nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		restHandler().ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
+
+// 启动运行: 选项错误为400, 程序或版本不存在为404, 请求体有上限
+func TestRestRunStart(t *testing.T) {
+	_, id := restTestSetup(t)
+	for _, c := range []struct {
+		name, target, body string
+		want               int
+	}{
+		{"ok", "/programs/" + string(id) + "/runs", `{"argv": "--n 1"}`, http.StatusCreated},
+		{"revision", "/programs/" + string(id) + "/runs?revision=1", `{}`, http.StatusCreated},
+		{"no program", "/programs/NOSUCHPROGRAM/runs", `{}`, http.StatusNotFound},
+		{"no revision", "/programs/" + string(id) + "/runs?revision=9", `{}`, http.StatusNotFound},
+		{"bad revision", "/programs/" + string(id) + "/runs?revision=x", `{}`, http.StatusBadRequest},
+		{"bad json", "/programs/" + string(id) + "/runs", `{"argv":`, http.StatusBadRequest},
+		{"bad limit", "/programs/" + string(id) + "/runs?memory=lots", `{}`, http.StatusBadRequest},
+		{"bad timeout", "/programs/" + string(id) + "/runs?timeout=-1s", `{}`, http.StatusBadRequest},
+		{"network per run", "/programs/" + string(id) + "/runs?network=" + networkNone, `{}`, http.StatusBadRequest},
+		{"body too large", "/programs/" + string(id) + "/runs", `{"argv": "` + strings.Repeat("a", restRunBodyMax) + `"}`, http.StatusBadRequest},
+	} {
+		w := restTestDo(http.MethodPost, c.target, strings.NewReader(c.body))
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d: %s", c.name, w.Code, c.want, w.Body)
+		}
+	}
+}
+
+// 运行结束后通过/runs/{id}/data按名称读取输出
+func TestRestRunData(t *testing.T) {
+	f, id := restTestSetup(t)
+	sub := eventSubscribe(eventFilter{program: id})
+	defer eventUnsubscribe(sub)
+	w := restTestDo(http.MethodPost, "/programs/"+string(id)+"/runs", strings.NewReader(`{}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	runID := strings.Split(w.Body.String(), `"`)[3] // {"id":"..."}
+	if err := dataStore(runID, "table", "text/csv", []byte("a,b\n1,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := resultGet(runID)
+	f.exit(v.Container, 0, "", "", false)
+	processTestStoped(t, sub, runID)
+	processTestHistory(t, runID, "stoped") // stoped事件先于输出写入队列, 运行记录在输出之后更新
+
+	w = restTestDo(http.MethodGet, "/runs/"+runID+"/data?name=table", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "a,b\n1,2\n" || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("data: %d %q %s", w.Code, w.Body, w.Header().Get("Content-Type"))
+	}
+	for _, c := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/runs/" + runID, http.StatusOK},
+		{http.MethodGet, "/runs/" + runID + "/data?name=other", http.StatusNotFound},
+		{http.MethodGet, "/runs/NOSUCHRUN/data", http.StatusNotFound},
+		{http.MethodGet, "/runs/NOSUCHRUN", http.StatusNotFound},
+		{http.MethodDelete, "/runs/" + runID, http.StatusNotFound}, // 已结束
+		{http.MethodPut, "/runs/" + runID, http.StatusMethodNotAllowed},
+	} {
+		if w = restTestDo(c.method, c.target, nil); w.Code != c.want {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.target, w.Code, c.want)
+		}
+	}
+}
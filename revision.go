@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 程序目录结构: storePath/程序ID/program.json(当前版本) + storePath/程序ID/版本号/(源文件及manifest.json)
+// 版本创建后不再修改, 运行使用启动时的版本目录, 切换版本不影响正在运行的容器
+
+const programStateName = "program.json"
+
+var (
+	errRevisionErr = errors.New("Invalid revision")
+	errNoRevision  = errors.New("No such revision")
+	errNoRollback  = errors.New("No earlier revision to roll back to")
+)
+
+// programEntry 程序的全部版本, current为start默认使用的版本
+type programEntry struct {
+	current   int
+	latest    int // 已分配的最大版本号, 包括正在构建的版本
+	revisions map[int]programInfo
+	runs      int64 // 启动次数
+	lastRun   time.Time
+	ctx       context.Context // 删除程序时取消, 终止所有版本的运行
+	cancel    context.CancelFunc
+}
+
+// programState program.json的内容: 当前版本及运行统计
+type programState struct {
+	Current int        `json:"current"`
+	Runs    int64      `json:"runs,omitempty"`
+	LastRun *time.Time `json:"lastRun,omitempty"`
+}
+
+// revisionInfo 版本列表中的一项
+type revisionInfo struct {
+	programManifest
+	Current bool `json:"current"`
+}
+
+func revisionDir(id programIndex, rev int) string {
+	return storePath + "/" + string(id) + "/" + strconv.Itoa(rev)
+}
+
+// revisionParse 解析选项中的版本号, 为空时返回0(当前版本)
+func revisionParse(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	rev, err := strconv.Atoi(v)
+	if err != nil || rev <= 0 {
+		return 0, errRevisionErr
+	}
+	return rev, nil
+}
+
+// promoteParse 解析上传选项promote, 默认为true
+func promoteParse(v string) (bool, error) {
+	if v == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// revisionGet 获取程序的版本rev, 0为当前版本
+func revisionGet(id programIndex, rev int) (programInfo, error) {
+	programLock.RLock()
+	defer programLock.RUnlock()
+	e, ok := programMapping[id]
+	if !ok {
+		return programInfo{}, errNoID
+	}
+	if rev == 0 {
+		rev = e.current
+	}
+	p, ok := e.revisions[rev]
+	if !ok {
+		return p, errNoRevision
+	}
+	return p, nil
+}
+
+// revisionCreate 为已有的程序创建新版本, promote为true时设为当前版本, 返回该版本
+func revisionCreate(id programIndex, s programInfo, src io.Reader, length int64, promote bool) (programInfo, error) {
+	if length > conf.Upload.MaxSize {
+		io.CopyN(ioutil.Discard, src, length)
+		return programInfo{}, errUploadSize
+	}
+	programLock.Lock()
+	e, ok := programMapping[id]
+	if ok {
+		e.latest++
+		s.revision = e.latest
+	}
+	programLock.Unlock()
+	if !ok {
+		io.CopyN(ioutil.Discard, src, length)
+		return programInfo{}, errNoID
+	}
+	s.id = id
+	s.created = time.Now()
+	if err := programStore(&s, src, length); err != nil {
+		return programInfo{}, err
+	}
+	programLock.Lock()
+	defer programLock.Unlock()
+	if e, ok = programMapping[id]; !ok { // 构建期间程序已被删除
+		revisionRemove(s)
+		os.Remove(storePath + "/" + string(id))
+		return programInfo{}, errNoID
+	}
+	s.ctx, s.cancel = e.ctx, e.cancel
+	e.revisions[s.revision] = s
+	if promote {
+		current := e.current
+		e.current = s.revision
+		if err := e.store(id); err != nil {
+			e.current = current
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// revisionRemove 删除版本的目录及镜像, 释放对源文件对象的引用
+func revisionRemove(p programInfo) {
+	os.RemoveAll(p.dir)
+	if p.options.Image != "" {
+		rt.ImageRemove(context.Background(), p.options.Image)
+	}
+	if p.sourceHash != "" {
+		objectRelease(p.sourceHash)
+	}
+}
+
+// revisionList 按版本号升序列出程序的全部版本
+func revisionList(id programIndex) ([]revisionInfo, error) {
+	programLock.RLock()
+	defer programLock.RUnlock()
+	e, ok := programMapping[id]
+	if !ok {
+		return nil, errNoID
+	}
+	l := make([]revisionInfo, 0, len(e.revisions))
+	for rev, p := range e.revisions {
+		l = append(l, revisionInfo{programManifest: p.manifest(), Current: rev == e.current})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Revision < l[j].Revision })
+	return l, nil
+}
+
+// programPromote 将版本rev设为当前版本
+func programPromote(id programIndex, rev int) error {
+	programLock.Lock()
+	defer programLock.Unlock()
+	e, ok := programMapping[id]
+	if !ok {
+		return errNoID
+	}
+	if _, ok = e.revisions[rev]; !ok {
+		return errNoRevision
+	}
+	current := e.current
+	e.current = rev
+	if err := e.store(id); err != nil {
+		e.current = current
+		return err
+	}
+	return nil
+}
+
+// programRollback 将当前版本回退到rev, rev为0时回退到当前版本之前的最近一个版本, 返回回退后的版本号
+func programRollback(id programIndex, rev int) (int, error) {
+	programLock.Lock()
+	defer programLock.Unlock()
+	e, ok := programMapping[id]
+	if !ok {
+		return 0, errNoID
+	}
+	if rev == 0 {
+		for v := range e.revisions {
+			if v < e.current && v > rev {
+				rev = v
+			}
+		}
+		if rev == 0 {
+			return 0, errNoRollback
+		}
+	} else if _, ok = e.revisions[rev]; !ok {
+		return 0, errNoRevision
+	} else if rev >= e.current {
+		return 0, errNoRollback
+	}
+	current := e.current
+	e.current = rev
+	if err := e.store(id); err != nil {
+		e.current = current
+		return 0, err
+	}
+	return rev, nil
+}
+
+// store 写入program.json
+func (e *programEntry) store(id programIndex) error {
+	state := programState{Current: e.current, Runs: e.runs}
+	if !e.lastRun.IsZero() {
+		state.LastRun = &e.lastRun
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return fileReplace(storePath+"/"+string(id)+"/"+programStateName, buf)
+}
+
+// programLoad 读取程序目录下的全部版本并校验源文件, program.json不存在时当前版本为最新的版本
+func programLoad(dir string) (*programEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	e := &programEntry{revisions: make(map[int]programInfo)}
+	e.ctx, e.cancel = context.WithCancel(ctxRoot)
+	for _, f := range files {
+		rev, err := strconv.Atoi(f.Name())
+		if err != nil || rev <= 0 || !f.IsDir() {
+			continue
+		}
+		p := &programInfo{}
+		revDir := dir + "/" + f.Name()
+		if pathStat(revDir+"/"+manifestName) == notExist && pathStat(revDir+"/status") == file {
+			err = p.cfgMigrate(revDir)
+		} else {
+			err = p.cfgLoader(revDir)
+		}
+		if err == nil {
+			err = p.sourceCheck()
+		}
+		if err != nil {
+			logger.Printf("Program: %s revision %d: %v.\n", filepath.Base(dir), rev, err)
+			continue
+		}
+		p.ctx, p.cancel = e.ctx, e.cancel
+		e.revisions[rev] = *p
+		if rev > e.latest {
+			e.latest = rev
+		}
+	}
+	if len(e.revisions) == 0 {
+		e.cancel()
+		return nil, errNoRevision
+	}
+	e.current = e.latest
+	if buf, err := ioutil.ReadFile(dir + "/" + programStateName); err == nil {
+		state := programState{}
+		if err = json.Unmarshal(buf, &state); err != nil {
+			e.cancel()
+			return nil, err
+		}
+		if _, ok := e.revisions[state.Current]; ok {
+			e.current = state.Current
+		}
+		e.runs = state.Runs
+		if state.LastRun != nil {
+			e.lastRun = *state.LastRun
+		}
+	}
+	return e, nil
+}
+
+// programMigrate 将旧的目录结构(源文件及配置直接位于程序目录中)转换为版本1
+func programMigrate(dir string) error {
+	if pathStat(dir+"/"+programStateName) != notExist ||
+		(pathStat(dir+"/"+manifestName) == notExist && pathStat(dir+"/status") == notExist) {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tmp := dir + "/.migrate"
+	if err = os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == ".migrate" {
+			continue
+		}
+		if err = os.Rename(dir+"/"+f.Name(), tmp+"/"+f.Name()); err != nil {
+			return err
+		}
+	}
+	id := filepath.Base(dir)
+	if err = os.Rename(tmp, dir+"/1"); err != nil {
+		return err
+	}
+	for _, format := range []string{archiveTgz, archiveZip} {
+		old := storePath + "/.archives/" + id + "." + format
+		if pathStat(old) == file {
+			os.Rename(old, legacyArchivePath(programInfo{id: programIndex(id), revision: 1, options: programOptions{Archive: format}}))
+		}
+	}
+	return (&programEntry{current: 1}).store(programIndex(id))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 依次切换当前版本, 每一步后检查内存中及program.json中的当前版本
+func TestRevisionPromoteRollback(t *testing.T) {
+	testSetup(t)
+	src := "print('hello')\n"
+	p, err := programCreate(programInfo{file: python3}, strings.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := p.id
+	for _, promote := range []bool{false, true} { // 版本2不设为当前版本, 版本3设为当前版本
+		if _, err = revisionCreate(id, programInfo{file: python3}, strings.NewReader(src), int64(len(src)), promote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		name    string
+		promote bool // 否则回退
+		rev     int
+		want    error
+		current int
+	}{
+		{"promote", true, 2, nil, 2},
+		{"promote missing", true, 9, errNoRevision, 2},
+		{"rollback previous", false, 0, nil, 1},
+		{"rollback past first", false, 0, errNoRollback, 1},
+		{"rollback missing", false, 9, errNoRevision, 1},
+		{"rollback to later", false, 3, errNoRollback, 1},
+		{"promote latest", true, 3, nil, 3},
+		{"rollback to first", false, 1, nil, 1},
+		{"rollback to current", false, 1, errNoRollback, 1},
+	} {
+		if c.promote {
+			err = programPromote(id, c.rev)
+		} else {
+			var rev int
+			if rev, err = programRollback(id, c.rev); err == nil && rev != c.current {
+				t.Errorf("%s: rolled back to %d, want %d", c.name, rev, c.current)
+			}
+		}
+		if err != c.want {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+		if p, _ := revisionGet(id, 0); p.revision != c.current {
+			t.Errorf("%s: current %d, want %d", c.name, p.revision, c.current)
+		}
+		if e, err := programLoad(storePath + "/" + string(id)); err != nil || e.current != c.current {
+			t.Errorf("%s: stored current %+v %v, want %d", c.name, e, err, c.current)
+		}
+	}
+	if err = programPromote("NOSUCHPROGRAM", 1); err != errNoID {
+		t.Errorf("promote unknown program: %v", err)
+	}
+	if _, err = programRollback("NOSUCHPROGRAM", 0); err != errNoID {
+		t.Errorf("rollback unknown program: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 运行记录保存于storePath/.runs/history.jsonl, 每行一条JSON, 同一运行的后写入的记录覆盖之前的记录
+// 启动时读入内存并压缩(只保留每个运行的最新记录, 删除超出history.retention或history.maxRecords的记录)
+// 运行开始及结束时各追加一条; 框架退出时仍在运行的记录在下次启动时标记为lost
+// 运行的日志(storePath/.logs)随记录一同删除
+
+const (
+	historyName     = "history.jsonl"
+	historyLimit    = 100 // 未指定limit时每页的数量
+	historyLimitMax = 1000
+	usageInterval   = 5 * time.Second // 运行期间采集资源使用的间隔
+	statusLost      = "lost"          // 框架在运行结束前退出
+)
+
+var (
+	errHistoryErr  = errors.New("Invalid run query")
+	historyLock    = sync.RWMutex{} // historyMapping, historyFile, historyLines
+	historyMapping = make(map[string]*runRecord)
+	historyFile    *os.File
+	historyLines   int // 文件中的记录数, 超出historyMapping的两倍时压缩
+)
+
+// runUsage 运行的资源使用, 运行时不支持时为0
+type runUsage struct {
+	CPUTime    int64 `json:"cpuTime"`    // ms
+	MemoryPeak int64 `json:"memoryPeak"` // bytes
+}
+
+// runRecord 一条运行记录, 在运行结果(runResult)之外记录参数及资源使用
+type runRecord struct {
+	runResult
+	Argv  string   `json:"argv"`
+	Usage runUsage `json:"usage"`
+}
+
+// runQuery listRuns的过滤条件, 为空的字段不参与过滤
+type runQuery struct {
+	program programIndex
+	status  string
+	since   time.Time // 开始时间不早于since
+	offset  int
+	limit   int
+}
+
+// runPage listRuns的一页, Total为过滤后的记录总数
+type runPage struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Runs   []runRecord `json:"runs"`
+}
+
+// historyOpen 读取并压缩运行记录
+func historyOpen(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	path := dir + "/" + historyName
+	if f, err := os.Open(path); err == nil {
+		s := bufio.NewScanner(f)
+		s.Buffer(make([]byte, 64<<10), 16<<20)
+		for line := 1; s.Scan(); line++ {
+			v := &runRecord{}
+			if err := json.Unmarshal(s.Bytes(), v); err != nil || v.ID == "" { // 写入中断的最后一行
+				logger.Printf("Run history line %d dropped: %v.\n", line, err)
+				continue
+			}
+			historyMapping[v.ID] = v
+		}
+		err = s.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, v := range historyMapping {
+		if v.Status == "running" {
+			v.Status = statusLost
+		}
+	}
+	return historyCompact(path)
+}
+
+// historyCompact 重写记录文件, 需持有historyLock
+func historyCompact(path string) error {
+	l := make([]*runRecord, 0, len(historyMapping))
+	for _, v := range historyMapping {
+		l = append(l, v)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Start.After(l[j].Start) })
+	deadline := time.Now().Add(-conf.History.Retention.Duration)
+	buf := []byte{}
+	n := 0
+	for _, v := range l {
+		if v.Status != "running" && (n >= conf.History.MaxRecords ||
+			conf.History.Retention.Duration > 0 && v.Start.Before(deadline)) {
+			delete(historyMapping, v.ID)
+			logRemove(v.ID)
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+		n++
+	}
+	if err := fileReplace(path, buf); err != nil {
+		return err
+	}
+	if historyFile != nil {
+		historyFile.Close()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		historyFile = nil
+		return err
+	}
+	historyFile, historyLines = f, n
+	return nil
+}
+
+// historyPut 保存运行记录
+func historyPut(v runRecord) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Println(err)
+		return
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	historyMapping[v.ID] = &v
+	if historyFile == nil {
+		return
+	}
+	if _, err = historyFile.Write(append(b, '\n')); err == nil {
+		err = historyFile.Sync() // 与消息队列一致, 每条记录写入后同步到磁盘
+	}
+	if err != nil {
+		logger.Printf("Run history write: %v.\n", err)
+		return
+	}
+	if historyLines++; historyLines > 2*len(historyMapping)+1000 {
+		if err = historyCompact(historyFile.Name()); err != nil {
+			logger.Printf("Run history compact: %v.\n", err)
+		}
+	}
+}
+
+// historyMaintain 每小时删除超出保留策略的记录及其日志, plz call this function with go routine
+func historyMaintain() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctxRoot.Done():
+			return
+		case <-ticker.C:
+		}
+		historyLock.Lock()
+		if historyFile != nil {
+			if err := historyCompact(historyFile.Name()); err != nil {
+				logger.Printf("Run history compact: %v.\n", err)
+			}
+		}
+		historyLock.Unlock()
+	}
+}
+
+// historyStart 记录运行开始
+func historyStart(runID, argv string) {
+	if r, ok := resultGet(runID); ok {
+		historyPut(runRecord{runResult: r, Argv: argv})
+	}
+}
+
+// historyDone 运行结束后以运行结果更新记录
+func historyDone(runID string, usage runUsage) {
+	r, ok := resultGet(runID)
+	if !ok {
+		return
+	}
+	historyLock.RLock()
+	v, ok := historyMapping[runID]
+	var argv string
+	if ok {
+		argv = v.Argv
+	}
+	historyLock.RUnlock()
+	historyPut(runRecord{runResult: r, Argv: argv, Usage: usage})
+}
+
+// historyGet 获取运行记录的副本
+func historyGet(runID string) (runRecord, bool) {
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+	v, ok := historyMapping[runID]
+	if !ok {
+		return runRecord{}, false
+	}
+	return *v, true
+}
+
+// historyParse 解析选项: program, status, since(RFC3339或unix时间戳, 见timeParse), offset, limit(默认historyLimit, 最大historyLimitMax)
+func historyParse(opt url.Values) (runQuery, error) {
+	q := runQuery{program: programIndex(opt.Get("program")), status: opt.Get("status"), limit: historyLimit}
+	var err error
+	if v := opt.Get("since"); v != "" {
+		if q.since, err = timeParse(v); err != nil {
+			return q, errHistoryErr
+		}
+	}
+	if v := opt.Get("offset"); v != "" {
+		if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+			return q, errHistoryErr
+		}
+	}
+	if v := opt.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit <= 0 || q.limit > historyLimitMax {
+			return q, errHistoryErr
+		}
+	}
+	return q, nil
+}
+
+// historyList 按开始时间降序(最近的在前)列出符合条件的运行记录
+func historyList(q runQuery) runPage {
+	l := []runRecord{}
+	historyLock.RLock()
+	for _, v := range historyMapping {
+		if q.program != "" && v.Program != q.program ||
+			q.status != "" && v.Status != q.status ||
+			v.Start.Before(q.since) {
+			continue
+		}
+		l = append(l, *v)
+	}
+	historyLock.RUnlock()
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].Start.Equal(l[j].Start) {
+			return l[i].Start.After(l[j].Start)
+		}
+		return l[i].ID > l[j].ID
+	})
+	page := runPage{Total: len(l), Offset: q.offset, Runs: []runRecord{}}
+	if q.offset < len(l) {
+		end := q.offset + q.limit
+		if end > len(l) {
+			end = len(l)
+		}
+		page.Runs = l[q.offset:end]
+	}
+	return page
+}
+
+// usageSampler 运行期间定期采集资源使用, 保留CPU时间的最新值及内存的峰值
+type usageSampler struct {
+	usage runUsage
+	lock  sync.Mutex
+}
+
+func (s *usageSampler) sample(stats containerStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cpu := stats.CPUTime.Milliseconds(); cpu > s.usage.CPUTime {
+		s.usage.CPUTime = cpu
+	}
+	for _, m := range []int64{stats.MemoryUsage, stats.MemoryPeak} {
+		if m > s.usage.MemoryPeak {
+			s.usage.MemoryPeak = m
+		}
+	}
+}
+
+func (s *usageSampler) get() runUsage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.usage
+}
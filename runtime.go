@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// containerRuntime 运行程序的沙箱, 由config.json中的runtime.type选择
+// docker: Docker容器(默认); local: 本地进程; fake: 内存中的模拟实现, 用于测试
+type containerRuntime interface {
+	// Network 按网络策略准备网络, 返回沙箱访问框架的地址, 为空表示无法访问
+	Network(ctx context.Context, policy string) (string, error)
+	Create(ctx context.Context, spec containerSpec) (string, error)
+	// CopyIn 将宿主机上的src(文件或目录)复制到沙箱中的dst目录
+	CopyIn(ctx context.Context, id, dst, src string) error
+	// CopyOut 将沙箱中的文件src复制到宿主机上的dst目录
+	CopyOut(ctx context.Context, id, src, dst string) error
+	Start(ctx context.Context, id string) error
+	// Wait 等待退出, 返回退出码
+	Wait(ctx context.Context, id string) (int64, error)
+	// Logs 将stdout/stderr写入w, 直到退出或ctx取消, Start后需调用一次
+	Logs(ctx context.Context, id string, stdout, stderr io.Writer) error
+	// Kill 发送SIGTERM, grace后SIGKILL
+	Kill(ctx context.Context, id string, grace time.Duration) error
+	// Remove 强制删除, 未退出时直接终止
+	Remove(ctx context.Context, id string) error
+	Stats(ctx context.Context, id string) (containerStats, error)
+	// Commit 将已退出的沙箱保存为镜像ref, 供之后的Create使用
+	Commit(ctx context.Context, id, ref string) error
+	ImageExists(ctx context.Context, ref string) bool
+	ImageRemove(ctx context.Context, ref string) error
+}
+
+// containerSpec 创建沙箱的参数
+type containerSpec struct {
+	Image      string
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	Limits     resourceLimits
+	Network    string // 网络策略
+}
+
+// containerStats 沙箱的状态, 资源使用不支持时为0
+type containerStats struct {
+	Running     bool
+	OOMKilled   bool
+	MemoryUsage int64         // bytes
+	MemoryPeak  int64         // bytes
+	CPUTime     time.Duration // 累计的CPU时间
+}
+
+type runtimeConfig struct {
+	Type     string `json:"type"`     // docker, local, fake
+	Insecure bool   `json:"insecure"` // 确认local运行环境不提供隔离, 上传的代码以框架的权限运行
+}
+
+// 网络策略
+const (
+	networkNone       = "none"               // 无网络, 结果仅能通过stdout获取
+	networkFramework  = "framework"          // 仅可访问框架的:2076端口
+	networkDatasource = "datasource"         // 另外可访问该运行dbInfo中的数据源, 经框架转发
+	networkFull       = "full"               // 不限制
+	frameworkAddrEnv  = "AAF_FRAMEWORK_ADDR" // 传递给沙箱的框架地址
+)
+
+var (
+	rt                containerRuntime
+	errRuntimeErr     = errors.New("Unknown runtime")
+	errNetworkErr     = errors.New("Unknown network policy")
+	errNetworkRun     = errors.New("Network policy can only be set per program")
+	errNetworkSupport = errors.New("Network policy not supported by runtime")
+	errRuntimeLocal   = errors.New("Runtime local runs uploaded code on the host without isolation, set runtime.insecure to confirm")
+)
+
+// runtimeOpen 创建config中指定的runtime
+func runtimeOpen(cfg runtimeConfig) (containerRuntime, error) {
+	switch cfg.Type {
+	case "docker":
+		return newDockerRuntime()
+	case "local":
+		if !cfg.Insecure {
+			return nil, errRuntimeLocal
+		}
+		logger.Println("Warning: runtime local runs uploaded code on the host with the framework's privileges, it isolates nothing.")
+		return newLocalRuntime(storePath + "/.local")
+	case "fake":
+		return newFakeRuntime(), nil
+	}
+	return nil, errRuntimeErr
+}
+
+// networkCheck empty: 是否允许为空(使用默认策略)
+func networkCheck(policy string, empty bool) error {
+	switch policy {
+	case networkNone, networkFramework, networkDatasource, networkFull:
+		return nil
+	case "":
+		if empty {
+			return nil
+		}
+	}
+	return errNetworkErr
+}
@@ -0,0 +1,227 @@
+import java.io.ByteArrayOutputStream;
+import java.io.DataOutputStream;
+import java.io.IOException;
+import java.io.InputStream;
+import java.net.Socket;
+import java.net.URLEncoder;
+import java.nio.charset.StandardCharsets;
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.HashMap;
+import java.util.List;
+import java.util.Map;
+
+// SDK for Java algorithms, equivalent to driver.py
+// Main.main must call Driver.init(args) before any other method.
+public final class Driver {
+    public static final String Msql = "mysql";
+    public static final String SQL = "sqlserver";
+    public static final String Influxdb = "influxdb";
+
+    public static final String LogDebug = "debug";
+    public static final String LogInfo = "info";
+    public static final String LogWarning = "warning";
+    public static final String LogError = "error";
+
+    private static final String remoteAddr = System.getenv().getOrDefault("AAF_FRAMEWORK_ADDR", "172.17.0.1");
+    private static final int remotePort = 2076;
+    private static final String statusOK = "ok";
+
+    private static Socket s;
+    private static InputStream in;
+    private static DataOutputStream out;
+    private static String[] args = new String[0];
+
+    public static final class DBInfo {
+        public String Type = "";
+        public String Addr = "";
+        public String Database = "";
+        public String UserName = "";
+        public String Password = "";
+    }
+
+    private Driver() {
+    }
+
+    // args: the arguments of main, the first one is the token
+    public static synchronized void init(String[] argv) throws IOException {
+        if (s != null) {
+            return;
+        }
+        args = Arrays.copyOfRange(argv, 1, argv.length);
+        s = new Socket(remoteAddr, remotePort);
+        in = s.getInputStream();
+        out = new DataOutputStream(s.getOutputStream());
+        write(argv[0]);
+        if (!statusOK.equals(receive())) {
+            s.close();
+            System.exit(-1);
+        }
+    }
+
+    public static String[] Args() {
+        return args;
+    }
+
+    // send data to the framework, data is sent in windows, waiting for the framework's response after each window
+    // name: output name, null for the default output; contentType: MIME type of the output
+    public static synchronized int send(byte[] data, String name, String contentType) throws IOException {
+        String cmd = "send:window";
+        if (name != null && !name.isEmpty()) {
+            cmd += "&name=" + URLEncoder.encode(name, "UTF-8");
+        }
+        if (contentType != null && !contentType.isEmpty()) {
+            cmd += "&type=" + URLEncoder.encode(contentType, "UTF-8");
+        }
+        write(cmd);
+        if (!statusOK.equals(receive())) {
+            return -1;
+        }
+        int window = Integer.parseInt(receive());
+        out.writeInt(data.length);
+        for (int i = 0; ; i += window) {
+            out.write(data, i, Math.min(window, data.length - i));
+            out.flush();
+            if (!statusOK.equals(receive())) {
+                return -1;
+            }
+            if (i + window >= data.length) {
+                return 0;
+            }
+        }
+    }
+
+    public static int send(byte[] data) throws IOException {
+        return send(data, null, null);
+    }
+
+    public static int send(String data) throws IOException {
+        return send(data.getBytes(StandardCharsets.UTF_8), null, null);
+    }
+
+    // report progress(0-100) with an optional message, pushed by the framework immediately
+    public static synchronized int progress(double percent, String message) throws IOException {
+        write("progress:" + percent + ":" + message.replace("\0", ""));
+        return statusOK.equals(receive()) ? 0 : -1;
+    }
+
+    // level: LogDebug, LogInfo, LogWarning or LogError, pushed by the framework immediately
+    public static synchronized int log(String level, String text) throws IOException {
+        write("log:" + level + ":" + text.replace("\0", ""));
+        return statusOK.equals(receive()) ? 0 : -1;
+    }
+
+    // return a list of DBInfo which contains Type(db type), Addr(db address), UserName(db username), Password(db password), Database(db database)
+    public static synchronized List<DBInfo> getDBList() throws IOException {
+        write("dbList");
+        List<DBInfo> list = new ArrayList<>();
+        for (Map<String, String> v : new JsonReader(receive()).objects()) {
+            DBInfo t = new DBInfo();
+            t.Type = v.getOrDefault("type", "");
+            t.Addr = v.getOrDefault("addr", "");
+            t.Database = v.getOrDefault("database", "");
+            t.UserName = v.getOrDefault("username", "");
+            t.Password = v.getOrDefault("password", "");
+            list.add(t);
+        }
+        return list;
+    }
+
+    private static void write(String cmd) throws IOException {
+        out.write((cmd + "\0").getBytes(StandardCharsets.UTF_8));
+        out.flush();
+    }
+
+    private static String receive() throws IOException {
+        ByteArrayOutputStream buf = new ByteArrayOutputStream();
+        for (int c = in.read(); c != 0; c = in.read()) {
+            if (c < 0) {
+                throw new IOException("connection closed");
+            }
+            buf.write(c);
+        }
+        return new String(buf.toByteArray(), StandardCharsets.UTF_8);
+    }
+
+    // JsonReader parses an array of objects with string values, which is all dbList returns
+    private static final class JsonReader {
+        private final String s;
+        private int i;
+
+        JsonReader(String s) {
+            this.s = s;
+        }
+
+        List<Map<String, String>> objects() throws IOException {
+            List<Map<String, String>> list = new ArrayList<>();
+            if (peek() == 'n') { // null
+                return list;
+            }
+            expect('[');
+            if (peek() == ']') {
+                return list;
+            }
+            do {
+                Map<String, String> m = new HashMap<>();
+                expect('{');
+                if (peek() != '}') {
+                    do {
+                        String key = string();
+                        expect(':');
+                        m.put(key, string());
+                    } while (next() == ',');
+                    i--;
+                }
+                expect('}');
+                list.add(m);
+            } while (next() == ',');
+            return list;
+        }
+
+        private char peek() throws IOException {
+            while (i < s.length() && Character.isWhitespace(s.charAt(i))) {
+                i++;
+            }
+            if (i >= s.length()) {
+                throw new IOException("unexpected end of JSON");
+            }
+            return s.charAt(i);
+        }
+
+        private char next() throws IOException {
+            char c = peek();
+            i++;
+            return c;
+        }
+
+        private void expect(char c) throws IOException {
+            if (next() != c) {
+                throw new IOException("invalid JSON at " + (i - 1));
+            }
+        }
+
+        private String string() throws IOException {
+            expect('"');
+            StringBuilder b = new StringBuilder();
+            for (char c = s.charAt(i++); c != '"'; c = s.charAt(i++)) {
+                if (c == '\\') {
+                    c = s.charAt(i++);
+                    switch (c) {
+                        case 'b': c = '\b'; break;
+                        case 'f': c = '\f'; break;
+                        case 'n': c = '\n'; break;
+                        case 'r': c = '\r'; break;
+                        case 't': c = '\t'; break;
+                        case 'u':
+                            c = (char) Integer.parseInt(s.substring(i, i + 4), 16);
+                            i += 4;
+                            break;
+                        default: // " \ /
+                    }
+                }
+                b.append(c);
+            }
+            return b.toString();
+        }
+    }
+}
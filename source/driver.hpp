@@ -0,0 +1,308 @@
+// SDK for C/C++ algorithms, equivalent to driver.py (C++11, POSIX sockets, header only)
+// main must call driver::init(argc, argv) before any other function.
+#ifndef AAF_DRIVER_HPP
+#define AAF_DRIVER_HPP
+
+#include <arpa/inet.h>
+#include <netinet/in.h>
+#include <sys/socket.h>
+#include <unistd.h>
+
+#include <algorithm>
+#include <cctype>
+#include <cstdint>
+#include <cstdlib>
+#include <map>
+#include <sstream>
+#include <stdexcept>
+#include <string>
+#include <vector>
+
+namespace driver {
+
+const char *const Msql = "mysql";
+const char *const SQL = "sqlserver";
+const char *const Influxdb = "influxdb";
+
+const char *const LogDebug = "debug";
+const char *const LogInfo = "info";
+const char *const LogWarning = "warning";
+const char *const LogError = "error";
+
+struct DBInfo {
+    std::string Type;
+    std::string Addr;
+    std::string Database;
+    std::string UserName;
+    std::string Password;
+};
+
+namespace detail {
+
+const int remotePort = 2076;
+const std::string statusOK = "ok";
+
+inline int &sock() {
+    static int s = -1;
+    return s;
+}
+
+inline std::vector<std::string> &args() {
+    static std::vector<std::string> a;
+    return a;
+}
+
+inline void writeAll(const char *p, size_t n) {
+    while (n > 0) {
+        ssize_t w = ::send(sock(), p, n, 0);
+        if (w <= 0) {
+            throw std::runtime_error("driver: write failed");
+        }
+        p += w;
+        n -= static_cast<size_t>(w);
+    }
+}
+
+inline void write(const std::string &cmd) {
+    writeAll(cmd.c_str(), cmd.size() + 1); // with \0
+}
+
+inline std::string receive() {
+    std::string s;
+    char c;
+    for (;;) {
+        if (::recv(sock(), &c, 1, 0) != 1) {
+            throw std::runtime_error("driver: connection closed");
+        }
+        if (c == '\0') {
+            return s;
+        }
+        s += c;
+    }
+}
+
+inline std::string strip(std::string s) {
+    std::string out;
+    for (char c : s) {
+        if (c != '\0') {
+            out += c;
+        }
+    }
+    return out;
+}
+
+inline std::string urlEncode(const std::string &s) {
+    static const char hex[] = "0123456789ABCDEF";
+    std::string out;
+    for (unsigned char c : s) {
+        if (isalnum(c) || c == '-' || c == '_' || c == '.' || c == '~') {
+            out += static_cast<char>(c);
+        } else {
+            out += '%';
+            out += hex[c >> 4];
+            out += hex[c & 15];
+        }
+    }
+    return out;
+}
+
+// jsonReader parses an array of objects with string values, which is all dbList returns
+class jsonReader {
+public:
+    explicit jsonReader(const std::string &s) : s_(s), i_(0) {}
+
+    std::vector<std::map<std::string, std::string>> objects() {
+        std::vector<std::map<std::string, std::string>> list;
+        if (peek() == 'n') { // null
+            return list;
+        }
+        expect('[');
+        if (peek() == ']') {
+            return list;
+        }
+        do {
+            std::map<std::string, std::string> m;
+            expect('{');
+            if (peek() != '}') {
+                do {
+                    std::string key = string();
+                    expect(':');
+                    m[key] = string();
+                } while (next() == ',');
+                i_--;
+            }
+            expect('}');
+            list.push_back(m);
+        } while (next() == ',');
+        return list;
+    }
+
+private:
+    char peek() {
+        while (i_ < s_.size() && isspace(static_cast<unsigned char>(s_[i_]))) {
+            i_++;
+        }
+        if (i_ >= s_.size()) {
+            throw std::runtime_error("driver: unexpected end of JSON");
+        }
+        return s_[i_];
+    }
+
+    char next() {
+        char c = peek();
+        i_++;
+        return c;
+    }
+
+    void expect(char c) {
+        if (next() != c) {
+            throw std::runtime_error("driver: invalid JSON");
+        }
+    }
+
+    std::string string() {
+        expect('"');
+        std::string b;
+        for (char c = at(); c != '"'; c = at()) {
+            if (c != '\\') {
+                b += c;
+                continue;
+            }
+            switch (c = at()) {
+            case 'b': b += '\b'; break;
+            case 'f': b += '\f'; break;
+            case 'n': b += '\n'; break;
+            case 'r': b += '\r'; break;
+            case 't': b += '\t'; break;
+            case 'u': {
+                unsigned long u = std::stoul(s_.substr(i_, 4), nullptr, 16);
+                i_ += 4;
+                if (u < 0x80) { // UTF-8
+                    b += static_cast<char>(u);
+                } else if (u < 0x800) {
+                    b += static_cast<char>(0xC0 | (u >> 6));
+                    b += static_cast<char>(0x80 | (u & 0x3F));
+                } else {
+                    b += static_cast<char>(0xE0 | (u >> 12));
+                    b += static_cast<char>(0x80 | ((u >> 6) & 0x3F));
+                    b += static_cast<char>(0x80 | (u & 0x3F));
+                }
+                break;
+            }
+            default: // " \ /
+                b += c;
+            }
+        }
+        return b;
+    }
+
+    char at() {
+        if (i_ >= s_.size()) {
+            throw std::runtime_error("driver: unexpected end of JSON");
+        }
+        return s_[i_++];
+    }
+
+    const std::string &s_;
+    size_t i_;
+};
+
+} // namespace detail
+
+// argv[1] is the token, the rest are the arguments of the run
+inline void init(int argc, char **argv) {
+    if (detail::sock() >= 0) {
+        return;
+    }
+    if (argc < 2) {
+        throw std::runtime_error("driver: missing token");
+    }
+    for (int i = 2; i < argc; i++) {
+        detail::args().push_back(argv[i]);
+    }
+    const char *addr = getenv("AAF_FRAMEWORK_ADDR");
+    sockaddr_in sa{};
+    sa.sin_family = AF_INET;
+    sa.sin_port = htons(detail::remotePort);
+    if (inet_pton(AF_INET, addr ? addr : "172.17.0.1", &sa.sin_addr) != 1) {
+        throw std::runtime_error("driver: invalid framework address");
+    }
+    detail::sock() = socket(AF_INET, SOCK_STREAM, 0);
+    if (detail::sock() < 0 || connect(detail::sock(), reinterpret_cast<sockaddr *>(&sa), sizeof(sa)) != 0) {
+        throw std::runtime_error("driver: connect failed");
+    }
+    detail::write(argv[1]);
+    if (detail::receive() != detail::statusOK) {
+        close(detail::sock());
+        exit(-1);
+    }
+}
+
+inline const std::vector<std::string> &Args() {
+    return detail::args();
+}
+
+// send data to the framework, data is sent in windows, waiting for the framework's response after each window
+// name: output name, empty for the default output; contentType: MIME type of the output
+inline int send(const std::string &data, const std::string &name = "", const std::string &contentType = "") {
+    std::string cmd = "send:window";
+    if (!name.empty()) {
+        cmd += "&name=" + detail::urlEncode(name);
+    }
+    if (!contentType.empty()) {
+        cmd += "&type=" + detail::urlEncode(contentType);
+    }
+    detail::write(cmd);
+    if (detail::receive() != detail::statusOK) {
+        return -1;
+    }
+    size_t window = std::stoul(detail::receive());
+    uint32_t length = htonl(static_cast<uint32_t>(data.size()));
+    detail::writeAll(reinterpret_cast<const char *>(&length), 4);
+    for (size_t i = 0;; i += window) {
+        if (i < data.size()) {
+            detail::writeAll(data.data() + i, std::min(window, data.size() - i));
+        }
+        if (detail::receive() != detail::statusOK) {
+            return -1;
+        }
+        if (i + window >= data.size()) {
+            return 0;
+        }
+    }
+}
+
+// report progress(0-100) with an optional message, pushed by the framework immediately
+inline int progress(double percent, const std::string &message = "") {
+    std::ostringstream cmd;
+    cmd << "progress:" << percent << ":" << detail::strip(message);
+    detail::write(cmd.str());
+    return detail::receive() == detail::statusOK ? 0 : -1;
+}
+
+// level: LogDebug, LogInfo, LogWarning or LogError, pushed by the framework immediately
+inline int log(const std::string &level, const std::string &text) {
+    detail::write("log:" + level + ":" + detail::strip(text));
+    return detail::receive() == detail::statusOK ? 0 : -1;
+}
+
+// return a list of DBInfo which contains Type(db type), Addr(db address), UserName(db username), Password(db password), Database(db database)
+inline std::vector<DBInfo> getDBList() {
+    detail::write("dbList");
+    std::string data = detail::receive();
+    std::vector<DBInfo> list;
+    for (auto &v : detail::jsonReader(data).objects()) {
+        DBInfo t;
+        t.Type = v["type"];
+        t.Addr = v["addr"];
+        t.Database = v["database"];
+        t.UserName = v["username"];
+        t.Password = v["password"];
+        list.push_back(t);
+    }
+    return list;
+}
+
+} // namespace driver
+
+#endif
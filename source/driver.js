@@ -0,0 +1,162 @@
+'use strict';
+
+// SDK for Node.js algorithms, equivalent to driver.py
+// All functions return a Promise; only one request may be in flight at a time.
+//
+//   const driver = require('./driver');
+//   (async () => {
+//     const dbs = await driver.getDBList();
+//     await driver.progress(50, 'half');
+//     await driver.send('result');
+//     driver.close();
+//   })();
+
+const net = require('net');
+
+const Msql = 'mysql';
+const SQL = 'sqlserver';
+const Influxdb = 'influxdb';
+
+const LogDebug = 'debug';
+const LogInfo = 'info';
+const LogWarning = 'warning';
+const LogError = 'error';
+
+const _remoteAddr = process.env.AAF_FRAMEWORK_ADDR || '172.17.0.1';
+const _remotePort = 2076;
+const _statusOK = 'ok';
+
+let _s = null;
+let _init = null;
+let _buf = Buffer.alloc(0);
+let _waiting = [];
+
+class DBInfo {
+    constructor(v) {
+        this.Type = v.type;
+        this.Addr = v.addr;
+        this.Database = v.database;
+        this.UserName = v.username;
+        this.Password = v.password;
+    }
+}
+
+function _connect() {
+    if (_init) {
+        return _init;
+    }
+    _init = new Promise((resolve, reject) => {
+        _s = net.connect(_remotePort, _remoteAddr, () => {
+            _s.write(process.argv[2] + '\0');
+            _receive().then((status) => {
+                if (status !== _statusOK) {
+                    _s.destroy();
+                    process.exit(-1);
+                }
+                resolve();
+            }, reject);
+        });
+        _s.on('data', (data) => {
+            _buf = Buffer.concat([_buf, data]);
+            _dispatch();
+        });
+        _s.on('error', (err) => {
+            reject(err);
+            _waiting.forEach((w) => w.reject(err));
+            _waiting = [];
+        });
+    });
+    return _init;
+}
+
+// resolve the waiting receivers with the \0 terminated frames received so far
+function _dispatch() {
+    let i;
+    while (_waiting.length > 0 && (i = _buf.indexOf(0)) >= 0) {
+        const frame = _buf.slice(0, i).toString('utf-8');
+        _buf = _buf.slice(i + 1);
+        _waiting.shift().resolve(frame);
+    }
+}
+
+function _receive() {
+    return new Promise((resolve, reject) => {
+        _waiting.push({ resolve, reject });
+        _dispatch();
+    });
+}
+
+function _write(data) {
+    return new Promise((resolve) => _s.write(data, resolve));
+}
+
+// send data to the framework, data is sent in windows, waiting for the framework's response after each window
+// name: output name, undefined for the default output; contentType: MIME type of the output
+async function send(data, name, contentType) {
+    await _connect();
+    if (!Buffer.isBuffer(data)) {
+        data = Buffer.from(String(data));
+    }
+    let cmd = 'send:window';
+    if (name) {
+        cmd += '&name=' + encodeURIComponent(name);
+    }
+    if (contentType) {
+        cmd += '&type=' + encodeURIComponent(contentType);
+    }
+    await _write(cmd + '\0');
+    if (await _receive() !== _statusOK) {
+        return -1;
+    }
+    const window = parseInt(await _receive(), 10);
+    const length = Buffer.alloc(4);
+    length.writeUInt32BE(data.length);
+    await _write(length);
+    for (let i = 0; ; i += window) {
+        await _write(data.slice(i, i + window));
+        if (await _receive() !== _statusOK) {
+            return -1;
+        }
+        if (i + window >= data.length) {
+            return 0;
+        }
+    }
+}
+
+// report progress(0-100) with an optional message, pushed by the framework immediately
+async function progress(percent, message = '') {
+    await _connect();
+    await _write(`progress:${percent}:${message.replace(/\0/g, '')}\0`);
+    return await _receive() === _statusOK ? 0 : -1;
+}
+
+// level: LogDebug, LogInfo, LogWarning or LogError, pushed by the framework immediately
+async function log(level, text) {
+    await _connect();
+    await _write(`log:${level}:${text.replace(/\0/g, '')}\0`);
+    return await _receive() === _statusOK ? 0 : -1;
+}
+
+function Args() {
+    return process.argv.slice(3);
+}
+
+// return a list of DBInfo which contains Type(db type), Addr(db address), UserName(db username), Password(db password), Database(db database)
+async function getDBList() {
+    await _connect();
+    await _write('dbList\0');
+    return JSON.parse(await _receive()).map((v) => new DBInfo(v));
+}
+
+// close the connection, the process can't exit while it is open
+function close() {
+    if (_s) {
+        _s.end();
+    }
+}
+
+module.exports = {
+    Msql, SQL, Influxdb,
+    LogDebug, LogInfo, LogWarning, LogError,
+    DBInfo, send, progress, log, Args, getDBList, close,
+};
@@ -1,20 +1,25 @@
+import os
 import socket
 import sys
 import json
-import time
+from urllib.parse import quote
 
 Msql = 'mysql'
 SQL = 'sqlserver'
 Influxdb = 'influxdb'
 
-_remoteAddr = "172.17.0.1"
+LogDebug = 'debug'
+LogInfo = 'info'
+LogWarning = 'warning'
+LogError = 'error'
+
+_remoteAddr = os.environ.get('AAF_FRAMEWORK_ADDR', '172.17.0.1')
 _remotePort = 2076
 _s = object
 _init = False
 _args = object
 _zero = '\x00'.encode()
 _statusOK = 'ok'
-_step = 2048
 
 class DBInfo:
     def __init__(self):
@@ -40,25 +45,50 @@ def __init__():
         sys.exit(-1)
     _init = True
 
-def send(data: str) -> int:
+# send data to the framework, data is sent in windows, waiting for the framework's response after each window
+# name: output name, None for the default output; content_type: MIME type of the output
+def send(data, name: str = None, content_type: str = None) -> int:
     __init__()
     global _s
+    if isinstance(data, str):
+        data = data.encode()
     length = len(data)
-    l = _int32Encoder(length)
-    _s.send("send\0".encode())
-    data = data.encode()
-    if _receive() == "ok":
-        _s.send(l)
-        i = _step
-        while i <= length:
-            _s.send(data[i-_step:i])
-            i += _step
-            time.sleep(0.05)
-        if length % _step != 0:
-            _s.send(data[i-_step:])
-        if _receive() == "ok":
+    cmd = "send:window"
+    if name:
+        cmd += "&name=" + quote(name, safe='')
+    if content_type:
+        cmd += "&type=" + quote(content_type, safe='')
+    _s.send((cmd + "\0").encode())
+    if _receive() != _statusOK:
+        return -1
+    window = int(_receive())
+    _s.sendall(_int32Encoder(length))
+    i = 0
+    while True:
+        _s.sendall(data[i:i+window])
+        i += window
+        if _receive() != _statusOK:
+            return -1
+        if i >= length:
             return 0
-    return -1
+
+# report progress(0-100) with an optional message, pushed by the framework immediately
+def progress(percent: float, message: str = '') -> int:
+    __init__()
+    global _s
+    _s.sendall(("progress:%g:%s\0" % (percent, message.replace('\0', ''))).encode())
+    if _receive() != _statusOK:
+        return -1
+    return 0
+
+# level: LogDebug, LogInfo, LogWarning or LogError, pushed by the framework immediately
+def log(level: str, text: str) -> int:
+    __init__()
+    global _s
+    _s.sendall(("log:%s:%s\0" % (level, text.replace('\0', ''))).encode())
+    if _receive() != _statusOK:
+        return -1
+    return 0
 
 def Args():
     __init__()
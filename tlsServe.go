@@ -18,6 +18,7 @@ var (
 	errCloseConnect   = errors.New("Please close the connection")
 	listenerClosed    = false
 	m                 = sync.Mutex{}
+	sessionLock       = sync.RWMutex{}
 	tlsHandlerMapping = make(map[string]tcpHandlerFunc)
 	sessionMapping    = make(map[sessionID]net.Conn)
 )
@@ -86,7 +87,9 @@ func tcpListener(ln net.Listener) <-chan net.Conn {
 func tcpConnectHandler(conn net.Conn, mapping map[string]tcpHandlerFunc) {
 	sess := sessionIDGen(12)
 	logger.Printf("New connect from %s: %s.\n", conn.RemoteAddr().String(), sess)
+	sessionLock.Lock()
 	sessionMapping[sess] = conn
+	sessionLock.Unlock()
 	defer sessionClose(sess)
 	if f, ok := mapping["disconnect"]; ok {
 		defer f(conn, nil)
@@ -111,6 +114,9 @@ func tcpConnectHandler(conn net.Conn, mapping map[string]tcpHandlerFunc) {
 			switch err {
 			case errCloseConnect:
 				return
+			case errSwitchFrame:
+				frameServe(conn, r, sess, mapping)
+				return
 			case nil:
 				break
 			default:
@@ -139,15 +145,20 @@ func sessionIDGen(length int) sessionID {
 			return ""
 		}
 		id := sessionID(base64.RawURLEncoding.EncodeToString(b))
-		if _, ok := sessionMapping[id]; !ok {
+		sessionLock.RLock()
+		_, ok := sessionMapping[id]
+		sessionLock.RUnlock()
+		if !ok {
 			return id
 		}
 	}
 }
 
 func sessionClose(sess sessionID) {
+	sessionLock.Lock()
 	sessionMapping[sess].Close()
 	delete(sessionMapping, sess)
+	sessionLock.Unlock()
 	logger.Printf("Session: %s closed.\n", sess)
 }
 
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// 程序ID及运行ID使用ULID: 48位毫秒时间戳 + 80位随机数, Crockford base32编码为26个字符
+// 按字典序排列即为创建顺序; 同一毫秒内生成的ID随机数部分递增, 保证单调
+// 旧版本的程序ID(上传时的Unix时间)仍作为普通字符串使用
+
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	ulidLock sync.Mutex
+	ulidLast [16]byte
+)
+
+// newID 生成一个ULID, 随机数生成失败时返回错误
+func newID() (string, error) {
+	ulidLock.Lock()
+	defer ulidLock.Unlock()
+	var id [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	if last := binary.BigEndian.Uint64(ulidLast[:8]) >> 16; ms <= last { // 同一毫秒(或时钟回拨)
+		id = ulidLast
+		for i := 15; i >= 6; i-- { // 随机数部分加1
+			if id[i]++; id[i] != 0 {
+				break
+			}
+		}
+	} else if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	ulidLast = id
+	return ulidEncode(id), nil
+}
+
+// ulidEncode 128位从低位起按5位一组编码, 首字符为最高的3位
+func ulidEncode(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+// 连续生成的ID唯一且按字典序递增
+func TestNewIDMonotonic(t *testing.T) {
+	last := ""
+	for i := 0; i < 10000; i++ {
+		id, err := newID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 26 || id <= last {
+			t.Fatalf("id %q after %q", id, last)
+		}
+		last = id
+	}
+}